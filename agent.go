@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gosshpuppet/internal/agent"
+	"gosshpuppet/internal/logging"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// agentMain runs the built-in puppet agent, a replacement for `ssh -N -R` wrapped into autossh
+func agentMain(args []string) {
+	var (
+		argServer   string
+		argName     string
+		argKey      string
+		argHostKeys StringSliceArg
+		argForwards StringSliceArg
+
+		argDialTimeout       time.Duration
+		argKeepaliveInterval time.Duration
+		argKeepaliveCountMax int
+		argBackoffMin        time.Duration
+		argBackoffMax        time.Duration
+
+		argDebug bool
+	)
+
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	{
+		fs.StringVar(&argServer, "server", "", "Proxy address/port")
+		fs.StringVar(&argName, "name", "", "Puppet name")
+		fs.StringVar(&argKey, "key", "", "Puppet private key file")
+		fs.Var(&argHostKeys, "host-key", "Pinned proxy host key: SHA256 fingerprint or public key file, repeatable")
+		fs.Var(&argForwards, "forward", "Service to expose as SERVICE_PORT=HOST:PORT, repeatable")
+
+		fs.DurationVar(&argDialTimeout, "dial-timeout", time.Second*15, "Connection and handshake timeout")
+		fs.DurationVar(&argKeepaliveInterval, "keepalive-interval", time.Second*30, "Keepalive interval, 0 to disable")
+		fs.IntVar(&argKeepaliveCountMax, "keepalive-count-max", 3, "Missed keepalives before reconnecting")
+		fs.DurationVar(&argBackoffMin, "backoff-min", time.Second, "Initial reconnect delay")
+		fs.DurationVar(&argBackoffMax, "backoff-max", time.Minute, "Maximum reconnect delay")
+
+		fs.BoolVar(&argDebug, "debug", false, "Debug logs")
+	}
+
+	fs.Usage = func() {
+		w := os.Stdout
+		fs.SetOutput(w)
+		fmt.Fprintln(w, "Usage: gosshpuppet agent [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	// Logger
+	{
+		level := slog.LevelInfo
+		if argDebug {
+			level = slog.LevelDebug
+		}
+		ctx = logging.NewContext(ctx, logging.NewLogger(level))
+	}
+
+	if argServer == "" || argName == "" || argKey == "" {
+		logging.FromContext(ctx).Error("Server, name and key must be provided")
+		os.Exit(1)
+	}
+
+	if len(argForwards) == 0 {
+		logging.FromContext(ctx).Error("At least one forward must be provided")
+		os.Exit(1)
+	}
+
+	var forwards []agent.Forward
+	for _, v := range argForwards {
+		f, err := agent.ParseForward(v)
+		if err != nil {
+			logging.FromContext(ctx).Error("Failed to parse forward", "err", err)
+			os.Exit(1)
+		}
+		forwards = append(forwards, f)
+	}
+
+	hostKeyCallback, err := agent.PinnedHostKeyCallback(argHostKeys)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load pinned host keys", "err", err)
+		os.Exit(1)
+	}
+
+	b, err := os.ReadFile(argKey)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to read private key file "+argKey, "err", err)
+		os.Exit(1)
+	}
+
+	signer, err := gossh.ParsePrivateKey(b)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to parse private key file "+argKey, "err", err)
+		os.Exit(1)
+	}
+
+	a := &agent.Agent{
+		Server:          argServer,
+		Name:            argName,
+		Signer:          signer,
+		HostKeyCallback: hostKeyCallback,
+		Forwards:        forwards,
+
+		DialTimeout:       argDialTimeout,
+		KeepaliveInterval: argKeepaliveInterval,
+		KeepaliveCountMax: max(argKeepaliveCountMax, 1),
+		BackoffMin:        max(argBackoffMin, time.Millisecond),
+		BackoffMax:        max(argBackoffMax, argBackoffMin),
+	}
+
+	if err := a.Run(logging.NewContextGroupWith(ctx, "agent")); err != nil {
+		logging.FromContext(ctx).Error("Agent failed", "err", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"gosshpuppet/internal/keepalive"
+	"gosshpuppet/internal/logging"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Agent keeps reverse tunnels of a puppet to the proxy alive.
+type Agent struct {
+	Server          string
+	Name            string
+	Signer          gossh.Signer
+	HostKeyCallback gossh.HostKeyCallback
+	Forwards        []Forward
+
+	DialTimeout       time.Duration
+	KeepaliveInterval time.Duration
+	KeepaliveCountMax int
+	BackoffMin        time.Duration
+	BackoffMax        time.Duration
+}
+
+// Forward is a puppet service exposed through the proxy.
+type Forward struct {
+	ServicePort uint32
+	Target      string // local address to connect to
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%d=%s", f.ServicePort, f.Target)
+}
+
+// Run connects to the proxy and reconnects with exponential backoff until the context is done.
+func (a *Agent) Run(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
+
+	backoff := a.BackoffMin
+
+	for {
+		began := time.Now()
+
+		err := a.serve(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// connection was stable for a while, start over
+		if time.Since(began) > a.BackoffMax {
+			backoff = a.BackoffMin
+		}
+
+		delay := backoff/2 + rand.N(backoff/2+1)
+		logger.Warn(fmt.Sprintf("Disconnected, reconnecting in %v", delay.Round(time.Millisecond)), "err", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+
+		backoff = min(backoff*2, a.BackoffMax)
+	}
+}
+
+// serve runs a single connection until it breaks
+func (a *Agent) serve(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
+
+	dialer := net.Dialer{Timeout: a.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", a.Server)
+	if err != nil {
+		return fmt.Errorf("dialing server: %w", err)
+	}
+
+	// handshake must not hang forever
+	conn.SetDeadline(time.Now().Add(a.DialTimeout))
+
+	sshConn, chans, reqs, err := gossh.NewClientConn(conn, a.Server, &gossh.ClientConfig{
+		User:            a.Name,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(a.Signer)},
+		HostKeyCallback: a.HostKeyCallback,
+		Timeout:         a.DialTimeout,
+	})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("handshaking: %w", err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	client := gossh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	logger.Info("Connected to " + a.Server)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+
+	for _, f := range a.Forwards {
+		ln, err := client.ListenTCP(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(f.ServicePort)})
+		if err != nil {
+			return fmt.Errorf("requesting forward %v: %w", f, err)
+		}
+
+		logger.Info("Forwarding " + f.String())
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ln.Close()
+
+			a.serveForward(ctx, ln, f)
+		}()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.Wait()
+	}()
+
+	var keepalives <-chan time.Time
+	if a.KeepaliveInterval > 0 {
+		t := time.NewTicker(a.KeepaliveInterval)
+		defer t.Stop()
+		keepalives = t.C
+	}
+
+	var (
+		missed  int
+		replies = make(chan struct{}, 1)
+		pending bool
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-errCh:
+			if err == nil {
+				err = io.EOF
+			}
+			return err
+
+		case <-replies:
+			pending = false
+			missed = 0
+
+		case <-keepalives:
+			if pending {
+				missed++
+				if missed >= a.KeepaliveCountMax {
+					return errors.New("server is not responding to keepalives")
+				}
+				continue
+			}
+
+			pending = true
+			go func() {
+				if err := keepalive.Send(client); err == nil {
+					replies <- struct{}{}
+				}
+			}()
+		}
+	}
+}
+
+func (a *Agent) serveForward(ctx context.Context, ln net.Listener, f Forward) {
+	logger := logging.FromContext(ctx).With("forward", f.String())
+
+	for {
+		ch, err := ln.Accept()
+		if err != nil {
+			logger.Debug("Forward listener closed", "err", err)
+			return
+		}
+
+		go func() {
+			defer ch.Close()
+
+			dialer := net.Dialer{Timeout: a.DialTimeout}
+			conn, err := dialer.DialContext(ctx, "tcp", f.Target)
+			if err != nil {
+				logger.Error("Failed to dial target", "err", err)
+				return
+			}
+			defer conn.Close()
+
+			logger.Debug("Forwarding connection")
+
+			go func() {
+				defer ch.Close()
+				defer conn.Close()
+				io.Copy(ch, conn)
+			}()
+			io.Copy(conn, ch)
+		}()
+	}
+}
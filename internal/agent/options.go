@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ParseForward parses "SERVICE_PORT=HOST:PORT", e.g. "22=localhost:22".
+func ParseForward(s string) (Forward, error) {
+	port, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return Forward{}, fmt.Errorf("forward %q: expected SERVICE_PORT=HOST:PORT", s)
+	}
+
+	v, err := strconv.ParseUint(port, 10, 32)
+	if err != nil || v == 0 {
+		return Forward{}, fmt.Errorf("forward %q: invalid service port %q", s, port)
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return Forward{}, fmt.Errorf("forward %q: invalid target: %w", s, err)
+	}
+
+	return Forward{ServicePort: uint32(v), Target: target}, nil
+}
+
+// PinnedHostKeyCallback accepts only server host keys listed in pins.
+// A pin is either a SHA256 fingerprint ("SHA256:...") or a file with public keys in authorized_keys format.
+func PinnedHostKeyCallback(pins []string) (gossh.HostKeyCallback, error) {
+	var fingerprints []string
+
+	for _, pin := range pins {
+		if strings.HasPrefix(pin, "SHA256:") {
+			fingerprints = append(fingerprints, pin)
+			continue
+		}
+
+		b, err := os.ReadFile(pin)
+		if err != nil {
+			return nil, fmt.Errorf("reading host key file: %w", err)
+		}
+
+		for rest := b; len(bytes.TrimSpace(rest)) > 0; {
+			var key gossh.PublicKey
+			key, _, _, rest, err = gossh.ParseAuthorizedKey(rest)
+			if err != nil {
+				return nil, fmt.Errorf("parsing host key file %s: %w", pin, err)
+			}
+			fingerprints = append(fingerprints, gossh.FingerprintSHA256(key))
+		}
+	}
+
+	if len(fingerprints) == 0 {
+		return nil, fmt.Errorf("no host keys to pin")
+	}
+
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		fp := gossh.FingerprintSHA256(key)
+		if !slices.Contains(fingerprints, fp) {
+			return fmt.Errorf("host key %s of %s is not pinned", fp, hostname)
+		}
+		return nil
+	}, nil
+}
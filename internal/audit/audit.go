@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventAuth             = "auth"
+	EventPuppetConnect    = "puppet_connect"
+	EventPuppetReject     = "puppet_reject"
+	EventPuppetDisconnect = "puppet_disconnect"
+	EventChannelOpen      = "channel_open"
+	EventChannelReject    = "channel_reject"
+	EventChannelClose     = "channel_close"
+	EventExec             = "exec"
+	EventBan              = "ban"
+	EventUnban            = "unban"
+	EventGrant            = "grant"
+	EventRevoke           = "revoke"
+	EventKick             = "kick"
+	EventPing             = "ping"
+)
+
+// Event is a single audit record, written as a JSON line.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+
+	// Client
+	User        string `json:"user,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	Remote      string `json:"remote,omitempty"`
+	Session     string `json:"session,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Puppet service
+	Puppet        string `json:"puppet,omitempty"`
+	ServicePort   uint32 `json:"service_port,omitempty"`
+	PuppetSession string `json:"puppet_session,omitempty"`
+
+	// Access grant
+	Grant   string `json:"grant,omitempty"`
+	Grantee string `json:"grantee,omitempty"`
+
+	// Kicked client
+	Target string `json:"target,omitempty"`
+
+	Command string `json:"command,omitempty"`
+	Result  string `json:"result,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+
+	Duration        float64 `json:"duration_seconds,omitempty"`
+	BytesToPuppet   int64   `json:"bytes_to_puppet,omitempty"`
+	BytesFromPuppet int64   `json:"bytes_from_puppet,omitempty"`
+}
+
+// Log writes audit events as JSON Lines. A nil Log discards events.
+type Log struct {
+	m      sync.Mutex
+	w      io.WriteCloser
+	enc    *json.Encoder
+	logger *slog.Logger
+}
+
+// Open opens (appends to) an audit log file. Write failures are reported to the logger.
+func Open(path string, logger *slog.Logger) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+
+	return &Log{
+		w:      f,
+		enc:    json.NewEncoder(f),
+		logger: logger,
+	}, nil
+}
+
+// Record writes the event, setting its time if empty.
+func (l *Log) Record(e Event) {
+	if l == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if err := l.enc.Encode(e); err != nil {
+		l.logger.Error("Failed to write audit event", "event", e.Event, "err", err)
+	}
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.w.Close()
+}
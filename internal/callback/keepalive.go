@@ -0,0 +1,76 @@
+package callback
+
+import (
+	"context"
+	"fmt"
+	"gosshpuppet/internal/client"
+	"gosshpuppet/internal/keepalive"
+	"gosshpuppet/internal/logging"
+	"net"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// KeepaliveConnCallback probes every connection with keepalive requests, like OpenSSH ClientAliveInterval/ClientAliveCountMax.
+// A connection missing countMax replies in a row is closed, so its forwards are released.
+func KeepaliveConnCallback(baseCtx context.Context, interval time.Duration, countMax int) func(ssh.Context, net.Conn) net.Conn {
+	return func(ctx ssh.Context, conn net.Conn) net.Conn {
+		if interval <= 0 {
+			return conn
+		}
+
+		go func() {
+			logger := logging.FromContext(baseCtx).WithGroup("keepalive").With("remote", conn.RemoteAddr().String())
+
+			t := time.NewTicker(interval)
+			defer t.Stop()
+
+			var (
+				missed  int
+				replies = make(chan struct{}, 1)
+				pending bool
+			)
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+
+				case <-replies:
+					pending = false
+					missed = 0
+
+				case <-t.C:
+					// handshake is not complete yet
+					sshConn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+					if !ok {
+						continue
+					}
+
+					if pending {
+						missed++
+						if missed >= countMax {
+							client.FromSSHContext(ctx).Logger().Info(fmt.Sprintf("Closing unresponsive connection after %d missed keepalives", missed))
+							sshConn.Close()
+							return
+						}
+						continue
+					}
+
+					pending = true
+					go func() {
+						if err := keepalive.Send(sshConn); err != nil {
+							logger.Debug("Failed to send keepalive", "err", err)
+							return
+						}
+						replies <- struct{}{}
+					}()
+				}
+			}
+		}()
+
+		return conn
+	}
+}
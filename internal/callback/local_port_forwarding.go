@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"gosshpuppet/internal/client"
 	"gosshpuppet/internal/config"
+	"gosshpuppet/internal/keylookup"
 	"gosshpuppet/internal/logging"
 
 	"github.com/gliderlabs/ssh"
@@ -32,6 +33,18 @@ func LocalPortForwardingCallback(baseCtx context.Context, ac *config.AccessConfi
 			return false
 		}
 
+		// restricted by key lookup decision
+		if d := keylookup.FromContext(ctx); d != nil && !(d.AllowsPuppet(targetAddr) && d.AllowsService(targetPort)) {
+			cli.Logger().Debug(fmt.Sprintf("Local port forwarding to %s:%d not allowed by key lookup", targetAddr, targetPort))
+			return false
+		}
+
+		// restricted by permitopen key option
+		if !ac.Load().AdminKeyPermitsOpen(cli.Name(), cli.Key(), targetAddr, targetPort) {
+			cli.Logger().Debug(fmt.Sprintf("Local port forwarding to %s:%d not permitted by key options", targetAddr, targetPort))
+			return false
+		}
+
 		return true
 	}
 }
@@ -2,11 +2,18 @@ package callback
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"gosshpuppet/internal/audit"
 	"gosshpuppet/internal/client"
 	"gosshpuppet/internal/config"
+	"gosshpuppet/internal/keylookup"
+	"gosshpuppet/internal/limiter"
 	"gosshpuppet/internal/logging"
+	"gosshpuppet/internal/metrics"
+	"log/slog"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	gossh "golang.org/x/crypto/ssh"
@@ -14,9 +21,69 @@ import (
 	"github.com/gliderlabs/ssh"
 )
 
-const clientKindIdentifiedContextKey = "gosshpuppet-client-kind-identified"
+const (
+	clientKindIdentifiedContextKey = "gosshpuppet-client-kind-identified"
+	authReasonContextKey           = "gosshpuppet-auth-reason"
+	authFailedContextKey           = "gosshpuppet-auth-failed"
+)
+
+// ServerConfigCallback completes authentication once the client has signed with the identified key.
+// PublicKeyHandler is also called for unsigned queries of a key, so it only identifies the client.
+// A connection closed without authentication after rejected keys counts as one failure of its IP.
+func ServerConfigCallback(registry *client.Registry, lim *limiter.Limiter, auditLog *audit.Log) func(ssh.Context) *gossh.ServerConfig {
+	return func(ctx ssh.Context) *gossh.ServerConfig {
+		var done atomic.Bool
+
+		go func() {
+			<-ctx.Done()
+			if !done.Load() && ctx.Value(authFailedContextKey) != nil {
+				lim.Failure(ctx.RemoteAddr())
+			}
+		}()
+
+		return &gossh.ServerConfig{
+			AuthLogCallback: func(_ gossh.ConnMetadata, method string, err error) {
+				if method != "publickey" || err != nil {
+					return
+				}
+				done.Store(true)
+				authenticated(ctx, registry, lim, auditLog)
+			},
+		}
+	}
+}
 
-func PublicKeyHandler(baseCtx context.Context, ac *config.AccessConfigHolder) func(ssh.Context, ssh.PublicKey) bool {
+// authenticated records the client identified by PublicKeyHandler as connected
+func authenticated(ctx ssh.Context, registry *client.Registry, lim *limiter.Limiter, auditLog *audit.Log) {
+	cli := client.FromSSHContext(ctx)
+	reason, _ := ctx.Value(authReasonContextKey).(string)
+
+	cli.Logger().Info(fmt.Sprintf("%v authenticated as %v", cli.Name(), cli.Kind()))
+
+	metrics.AuthAttempts.WithLabelValues("success", reason).Inc()
+	auditLog.Record(audit.Event{
+		Event:       audit.EventAuth,
+		User:        cli.Name(),
+		Remote:      cli.Remote(),
+		Session:     cli.SessionID(),
+		Fingerprint: cli.KeyFingerprint(),
+		Result:      "success",
+		Reason:      reason,
+	})
+
+	lim.Authenticated(ctx.RemoteAddr())
+
+	kind := cli.Kind().String()
+	metrics.ClientsConnected.WithLabelValues(kind).Inc()
+	go func() {
+		<-ctx.Done()
+		metrics.ClientsConnected.WithLabelValues(kind).Dec()
+	}()
+
+	registry.Add(ctx)
+}
+
+func PublicKeyHandler(baseCtx context.Context, ac *config.AccessConfigHolder, lookup *keylookup.Cache, lim *limiter.Limiter, auditLog *audit.Log) func(ssh.Context, ssh.PublicKey) bool {
 	return func(ctx ssh.Context, key ssh.PublicKey) bool {
 		logger := logging.FromContext(baseCtx).WithGroup("pubkeycbk").With(
 			"user", ctx.User(),
@@ -26,43 +93,154 @@ func PublicKeyHandler(baseCtx context.Context, ac *config.AccessConfigHolder) fu
 			"session", ctx.SessionID(),
 		)
 
+		recordAuth := func(result, reason string) {
+			metrics.AuthAttempts.WithLabelValues(result, reason).Inc()
+
+			// certificates are audited by their underlying key, as everywhere else
+			fingerprint := gossh.FingerprintSHA256(key)
+			if cert, ok := key.(*gossh.Certificate); ok {
+				fingerprint = gossh.FingerprintSHA256(cert.Key)
+			}
+
+			auditLog.Record(audit.Event{
+				Event:       audit.EventAuth,
+				User:        ctx.User(),
+				Remote:      ctx.RemoteAddr().String(),
+				Session:     ctx.SessionID(),
+				Fingerprint: fingerprint,
+				Result:      result,
+				Reason:      reason,
+			})
+
+			// attempts of an identified or banned client are not guesses,
+			// others are counted once the connection fails to authenticate
+			if result == "failure" && reason != "already_identified" && reason != "banned" {
+				ctx.SetValue(authFailedContextKey, true)
+			}
+		}
+
 		// Do not re-identify client
 		if ctx.Value(clientKindIdentifiedContextKey) != nil {
 			logger.Debug("Client is already identified")
+			recordAuth("failure", "already_identified")
+			return false
+		}
+
+		// Banned in the middle of the handshake
+		if lim.Banned(ctx.RemoteAddr()) {
+			logger.Debug("Remote address is banned")
+			recordAuth("failure", "banned")
 			return false
 		}
 
 		// Ensure user is lowercased for sake of comparison
 		if ctx.User() != strings.ToLower(ctx.User()) {
 			logger.Debug("User name is not lowercase, rejecting")
+			recordAuth("failure", "user_not_lowercase")
 			return false
 		}
 
 		var kind = client.ClientUnknown
 		var cfg = ac.Load()
+		var lookupReason string
 
 		// Detect client kind
-		switch {
-		case cfg.IsPuppet(ctx.User(), key):
-			logger.Debug("Public key found in puppet list")
-			kind = client.ClientPuppet
+		if cert, ok := key.(*gossh.Certificate); ok {
+			logger = logger.With(
+				"cert_id", cert.KeyId,
+				"cert_serial", cert.Serial,
+				"ca_fingerprint", gossh.FingerprintSHA256(cert.SignatureKey),
+			)
 
-		case cfg.IsAdmin(ctx.User(), key):
-			logger.Debug("Public key found in admin list")
-			kind = client.ClientAdmin
+			puppetErr := cfg.CheckPuppetCertificate(ctx.User(), ctx.RemoteAddr(), cert)
+			adminErr := cfg.CheckAdminCertificate(ctx.User(), ctx.RemoteAddr(), cert)
 
-		default:
-			logger.Debug("Public key is unknown")
-			return false
+			switch {
+			case puppetErr == nil:
+				logger.Debug("Certificate signed by puppet authority")
+				kind = client.ClientPuppet
+
+			case adminErr == nil:
+				logger.Debug("Certificate signed by admin authority")
+				kind = client.ClientAdmin
+
+			case errors.Is(puppetErr, config.ErrSourceNotAllowed), errors.Is(adminErr, config.ErrSourceNotAllowed):
+				logger.Info("Remote address is not in allowed sources", "puppet_err", puppetErr, "admin_err", adminErr)
+				recordAuth("failure", "source_not_allowed")
+				return false
+
+			default:
+				logger.Debug("Certificate is rejected", "puppet_err", puppetErr, "admin_err", adminErr)
+				recordAuth("failure", "certificate_rejected")
+				return false
+			}
+		} else {
+			puppetErr := cfg.CheckPuppet(ctx.User(), ctx.RemoteAddr(), key)
+			adminErr := cfg.CheckAdmin(ctx.User(), ctx.RemoteAddr(), key)
+
+			switch {
+			case puppetErr == nil:
+				logger.Debug("Public key found in puppet list")
+				kind = client.ClientPuppet
+
+			case adminErr == nil:
+				logger.Debug("Public key found in admin list")
+				kind = client.ClientAdmin
+
+			case errors.Is(puppetErr, config.ErrPuppetImpersonation):
+				logger.Warn("Impersonation attempt: puppet key is bound to another name")
+				recordAuth("failure", "impersonation")
+				return false
+
+			case errors.Is(puppetErr, config.ErrSourceNotAllowed), errors.Is(adminErr, config.ErrSourceNotAllowed):
+				logger.Info("Remote address is not in allowed sources", "puppet_err", puppetErr, "admin_err", adminErr)
+				recordAuth("failure", "source_not_allowed")
+				return false
+
+			case errors.Is(puppetErr, config.ErrKeyRestricted), errors.Is(adminErr, config.ErrKeyRestricted):
+				logger.Info("Public key is restricted by its options", "puppet_err", puppetErr, "admin_err", adminErr)
+				recordAuth("failure", "key_restricted")
+				return false
+
+			case lookup != nil:
+				// looked up keys have no entry of their own, only global sources apply
+				if err := cfg.CheckSource(ctx.RemoteAddr()); err != nil {
+					logger.Info("Remote address is not in allowed sources", "err", err)
+					recordAuth("failure", "source_not_allowed")
+					return false
+				}
+
+				var reason string
+				kind, reason = lookupKey(ctx, logger, lookup, key)
+				if kind == client.ClientUnknown {
+					recordAuth("failure", reason)
+					return false
+				}
+				lookupReason = reason
+
+			default:
+				logger.Debug("Public key is unknown")
+				recordAuth("failure", "unknown_key")
+				return false
+			}
 		}
 
-		logger.Info(fmt.Sprintf("%v authenticated as %v", ctx.User(), kind))
+		logger.Debug(fmt.Sprintf("%v is identified as %v", ctx.User(), kind))
+
+		reason := kind.String() + "_key"
+		if _, ok := key.(*gossh.Certificate); ok {
+			reason = kind.String() + "_certificate"
+		} else if lookupReason != "" {
+			reason = kind.String() + "_" + lookupReason
+		}
+		ctx.SetValue(authReasonContextKey, reason)
 
 		client.SetSSHContext(ctx, client.NewClient(
 			ctx.User(),
 			ctx.RemoteAddr().String(),
 			ctx.SessionID(),
 			kind,
+			key,
 			logging.FromContext(baseCtx).WithGroup("client").With(
 				"name", ctx.User(),
 				"kind", kind.String(),
@@ -75,3 +253,50 @@ func PublicKeyHandler(baseCtx context.Context, ac *config.AccessConfigHolder) fu
 		return true
 	}
 }
+
+// lookupKey identifies an unknown key by the external source.
+// The client kind is unknown if the key is denied, the reason tells how the decision was made.
+func lookupKey(ctx ssh.Context, logger *slog.Logger, lookup *keylookup.Cache, key ssh.PublicKey) (client.ClientKind, string) {
+	d, stale, err := lookup.Lookup(ctx, keylookup.Query{
+		User:        ctx.User(),
+		KeyType:     key.Type(),
+		Fingerprint: gossh.FingerprintSHA256(key),
+	})
+	if errors.Is(err, keylookup.ErrBusy) {
+		logger.Warn("Key lookup is busy, rejecting", "err", err)
+		return client.ClientUnknown, "lookup_busy"
+	}
+	if err != nil {
+		logger.Error("Failed to look up public key", "err", err)
+		return client.ClientUnknown, "lookup_error"
+	}
+
+	reason := "lookup"
+	if stale {
+		logger.Warn("Key lookup failed, using the last known decision")
+		reason = "lookup_stale"
+	}
+
+	var kind client.ClientKind
+
+	switch d.Access {
+	case keylookup.AccessAdmin:
+		kind = client.ClientAdmin
+
+	case keylookup.AccessPuppet:
+		if !d.AllowsPuppet(ctx.User()) {
+			logger.Debug("Public key is denied by lookup for this puppet name")
+			return client.ClientUnknown, "lookup_denied"
+		}
+		kind = client.ClientPuppet
+
+	default:
+		logger.Debug("Public key is denied by lookup")
+		return client.ClientUnknown, "lookup_denied"
+	}
+
+	logger.Debug(fmt.Sprintf("Public key is identified by lookup as %v", kind))
+	keylookup.SetSSHContext(ctx, d)
+
+	return kind, reason
+}
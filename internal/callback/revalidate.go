@@ -0,0 +1,136 @@
+package callback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gosshpuppet/internal/client"
+	"gosshpuppet/internal/config"
+	"gosshpuppet/internal/keylookup"
+	"gosshpuppet/internal/logging"
+	"slices"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ForwardRevoker is an interface for tearing down puppet forwards.
+type ForwardRevoker interface {
+	Forwards(sessionID string) []uint32
+	CancelForward(sessionID string, servicePort uint32) bool
+}
+
+// GrantChecker is an interface for checking access grants, which allow admins what the access config does not.
+type GrantChecker interface {
+	Allows(admin, puppet string, servicePort uint32) bool
+}
+
+// RevalidateConnections re-evaluates live connections against a reloaded access config.
+// Connections whose key is no longer accepted are closed, puppet forwards of services no longer allowed are torn down,
+// as are admin channels to puppet services no longer allowed.
+func RevalidateConnections(baseCtx context.Context, cfg *config.AccessConfig, registry *client.Registry, fr ForwardRevoker, grants GrantChecker) {
+	logger := logging.FromContext(baseCtx).WithGroup("revalidate")
+
+	var kept, closed, forwards, channels int
+
+	for _, ctx := range registry.Connections() {
+		cli := client.FromSSHContext(ctx)
+		logger := logger.With(
+			"name", cli.Name(),
+			"kind", cli.Kind().String(),
+			"session", cli.SessionID(),
+			"remote", cli.Remote(),
+		)
+
+		if err := checkAccess(cfg, ctx, cli); err != nil {
+			if client.Disconnect(ctx) {
+				logger.Info("Session is closed: access revoked", "err", err)
+				closed++
+			}
+			continue
+		}
+
+		var revoked []uint32
+		if cli.IsPuppet() {
+			for _, port := range fr.Forwards(cli.SessionID()) {
+				if puppetServiceAllowed(ctx, cfg, cli, port) {
+					continue
+				}
+				if fr.CancelForward(cli.SessionID(), port) {
+					revoked = append(revoked, port)
+				}
+			}
+			slices.Sort(revoked)
+		}
+
+		var closedChannels []string
+		if cli.IsAdmin() {
+			for _, ch := range registry.CloseChannels(cli.SessionID(), func(ch client.Channel) bool {
+				return adminChannelAllowed(ctx, cfg, grants, cli, ch)
+			}) {
+				closedChannels = append(closedChannels, fmt.Sprintf("%s:%d", ch.Puppet, ch.ServicePort))
+			}
+		}
+
+		kept++
+		forwards += len(revoked)
+		channels += len(closedChannels)
+
+		switch {
+		case len(revoked) > 0:
+			logger.Info(fmt.Sprintf("Session is kept, forwards revoked: %v", revoked))
+		case len(closedChannels) > 0:
+			logger.Info(fmt.Sprintf("Session is kept, channels closed: %v", closedChannels))
+		default:
+			logger.Debug("Session is kept")
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Sessions revalidated: %d kept, %d closed, %d forwards revoked, %d channels closed", kept, closed, forwards, channels))
+}
+
+// adminChannelAllowed tells whether the admin could still open the channel, as checked when it was opened
+func adminChannelAllowed(ctx ssh.Context, cfg *config.AccessConfig, grants GrantChecker, cli *client.Client, ch client.Channel) bool {
+	if !cfg.AdminCanAccess(cli.Name(), ch.Puppet, ch.ServicePort) && !grants.Allows(cli.Name(), ch.Puppet, ch.ServicePort) {
+		return false
+	}
+	if _, ok := cfg.Services[ch.ServicePort]; !ok {
+		return false
+	}
+	if d := keylookup.FromContext(ctx); d != nil && !(d.AllowsPuppet(ch.Puppet) && d.AllowsService(ch.ServicePort)) {
+		return false
+	}
+	return cfg.AdminKeyPermitsOpen(cli.Name(), cli.Key(), ch.Puppet, ch.ServicePort)
+}
+
+// checkAccess tells whether the client would still authenticate with the same key and kind
+func checkAccess(cfg *config.AccessConfig, ctx ssh.Context, cli *client.Client) error {
+	key := cli.Key()
+	if key == nil {
+		return errors.New("unknown client")
+	}
+
+	// authorized by the key lookup, not the config, only global sources apply
+	if keylookup.FromContext(ctx) != nil {
+		return cfg.CheckSource(ctx.RemoteAddr())
+	}
+
+	cert, isCert := key.(*gossh.Certificate)
+
+	switch {
+	case cli.IsPuppet() && isCert:
+		return cfg.CheckPuppetCertificate(cli.Name(), ctx.RemoteAddr(), cert)
+
+	case cli.IsPuppet():
+		return cfg.CheckPuppet(cli.Name(), ctx.RemoteAddr(), key)
+
+	case cli.IsAdmin() && isCert:
+		return cfg.CheckAdminCertificate(cli.Name(), ctx.RemoteAddr(), cert)
+
+	case cli.IsAdmin():
+		return cfg.CheckAdmin(cli.Name(), ctx.RemoteAddr(), key)
+
+	default:
+		return errors.New("unknown client")
+	}
+}
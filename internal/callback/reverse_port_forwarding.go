@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"gosshpuppet/internal/client"
 	"gosshpuppet/internal/config"
+	"gosshpuppet/internal/keylookup"
 	"gosshpuppet/internal/logging"
 
 	"github.com/gliderlabs/ssh"
@@ -32,7 +33,7 @@ func ReversePortForwardingCallback(baseCtx context.Context, ac *config.AccessCon
 		}
 
 		// allowed only for specific ports
-		if _, ok := ac.Load().Services[remoteBindPort]; !ok {
+		if !puppetServiceAllowed(ctx, ac.Load(), cli, remoteBindPort) {
 			cli.Logger().Debug(fmt.Sprintf("Reverse port forwarding not allowed for port %d", remoteBindPort))
 			return false
 		}
@@ -40,3 +41,13 @@ func ReversePortForwardingCallback(baseCtx context.Context, ac *config.AccessCon
 		return true
 	}
 }
+
+// puppetServiceAllowed reports whether the puppet may expose the service: by the key lookup decision it is authorized by,
+// or by the config and permitlisten options of its key.
+func puppetServiceAllowed(ctx ssh.Context, cfg *config.AccessConfig, cli *client.Client, servicePort uint32) bool {
+	if d := keylookup.FromContext(ctx); d != nil {
+		_, ok := cfg.Services[servicePort]
+		return ok && d.AllowsService(servicePort)
+	}
+	return cfg.PuppetServiceAllowed(cli.Name(), ctx.RemoteAddr(), cli.Key(), servicePort) && cfg.PuppetKeyPermitsListen(cli.Name(), cli.Key(), servicePort)
+}
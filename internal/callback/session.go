@@ -2,7 +2,9 @@ package callback
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"gosshpuppet/internal/audit"
 	"gosshpuppet/internal/client"
 	"gosshpuppet/internal/logging"
 	"io"
@@ -37,9 +39,12 @@ func SessionRequestCallback(baseCtx context.Context) func(ssh.Session, string) b
 	}
 }
 
+// ErrCommandFailed is wrapped by errors of commands which already wrote the failure to the session
+var ErrCommandFailed = errors.New("command failed")
+
 type CommandInterpreter func(ctx context.Context, user string, args []string, w io.Writer) error
 
-func SessionExecCallback(i CommandInterpreter) func(s ssh.Session) {
+func SessionExecCallback(i CommandInterpreter, auditLog *audit.Log) func(s ssh.Session) {
 	return func(sess ssh.Session) {
 		cli := client.FromSSHContext(sess.Context())
 
@@ -51,8 +56,28 @@ func SessionExecCallback(i CommandInterpreter) func(s ssh.Session) {
 
 		args := sess.Command()
 
-		if err := i(sess.Context(), sess.User(), args, sess); err != nil {
-			sess.Write([]byte(fmt.Sprintf("Error: %s\n", err)))
+		err := i(sess.Context(), sess.User(), args, sess)
+
+		event := audit.Event{
+			Event:       audit.EventExec,
+			User:        cli.Name(),
+			Kind:        cli.Kind().String(),
+			Remote:      cli.Remote(),
+			Session:     cli.SessionID(),
+			Fingerprint: cli.KeyFingerprint(),
+			Command:     sess.RawCommand(),
+			Result:      "success",
+		}
+		if err != nil {
+			event.Result = "failure"
+			event.Reason = err.Error()
+		}
+		auditLog.Record(event)
+
+		if err != nil {
+			if !errors.Is(err, ErrCommandFailed) {
+				sess.Write([]byte(fmt.Sprintf("Error: %s\n", err)))
+			}
 			sess.Exit(1)
 			return
 		}
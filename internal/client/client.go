@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"log/slog"
 	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 const ClientSSHContextKey = "gosshpuppet-client-kind"
@@ -23,16 +26,18 @@ type Client struct {
 	remote    string
 	sessionID string
 	kind      ClientKind
+	key       ssh.PublicKey
 	logger    *slog.Logger
 	createdAt time.Time
 }
 
-func NewClient(name, remote, sessionID string, t ClientKind, logger *slog.Logger, createdAt time.Time) *Client {
+func NewClient(name, remote, sessionID string, t ClientKind, key ssh.PublicKey, logger *slog.Logger, createdAt time.Time) *Client {
 	return &Client{
 		name:      name,
 		remote:    remote,
 		sessionID: sessionID,
 		kind:      t,
+		key:       key,
 		logger:    logger,
 		createdAt: createdAt,
 	}
@@ -66,6 +71,23 @@ func (c *Client) IsPuppet() bool {
 	return c.kind == ClientPuppet
 }
 
+// Key returns the public key (or certificate) the client authenticated with, nil for unknown clients.
+func (c *Client) Key() ssh.PublicKey {
+	return c.key
+}
+
+// KeyFingerprint returns SHA256 fingerprint of the authentication key, empty for unknown clients.
+// Certificates are fingerprinted by their underlying key.
+func (c *Client) KeyFingerprint() string {
+	if c.key == nil {
+		return ""
+	}
+	if cert, ok := c.key.(*gossh.Certificate); ok {
+		return gossh.FingerprintSHA256(cert.Key)
+	}
+	return gossh.FingerprintSHA256(c.key)
+}
+
 func (c *Client) Logger() *slog.Logger {
 	return c.logger
 }
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"gosshpuppet/internal/logging"
 	"time"
 
@@ -11,9 +12,10 @@ func SetSSHContext(ctx ssh.Context, cli *Client) {
 	ctx.SetValue(ClientSSHContextKey, cli)
 }
 
-func FromSSHContext(ctx ssh.Context) *Client {
+// FromSSHContext returns the client of the connection, any context derived from it (e.g. of a session) works too
+func FromSSHContext(ctx context.Context) *Client {
 	if v := ctx.Value(ClientSSHContextKey); v != nil {
 		return v.(*Client)
 	}
-	return NewClient("unknown", "unknown", "unknown", ClientUnknown, logging.NoopLogger(), time.Now())
+	return NewClient("unknown", "unknown", "unknown", ClientUnknown, nil, logging.NoopLogger(), time.Now())
 }
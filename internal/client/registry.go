@@ -0,0 +1,153 @@
+package client
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Registry keeps track of live authenticated connections and channels they opened.
+type Registry struct {
+	m     sync.Mutex
+	conns map[string]*connection // session id -> connection
+}
+
+type connection struct {
+	ctx      ssh.Context
+	channels []openChannel // oldest first
+}
+
+type openChannel struct {
+	*Channel
+	close func()
+}
+
+// Connection is a live authenticated connection.
+type Connection struct {
+	Client        *Client
+	ClientVersion string
+	Channels      []Channel // open direct-tcpip channels, oldest first
+}
+
+// Channel is a direct-tcpip channel opened to a puppet service.
+type Channel struct {
+	Puppet        string
+	ServicePort   uint32
+	PuppetSession string
+	OpenedAt      time.Time
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		conns: make(map[string]*connection),
+	}
+}
+
+// Add registers an identified client connection until its context is done.
+func (r *Registry) Add(ctx ssh.Context) {
+	r.m.Lock()
+	r.conns[ctx.SessionID()] = &connection{ctx: ctx}
+	r.m.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		r.m.Lock()
+		delete(r.conns, ctx.SessionID())
+		r.m.Unlock()
+	}()
+}
+
+// Connections returns contexts of live connections.
+func (r *Registry) Connections() []ssh.Context {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	ret := make([]ssh.Context, 0, len(r.conns))
+	for _, c := range r.conns {
+		ret = append(ret, c.ctx)
+	}
+	return ret
+}
+
+// List returns live connections with their channels, oldest first.
+func (r *Registry) List() []Connection {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	ret := make([]Connection, 0, len(r.conns))
+	for _, c := range r.conns {
+		conn := Connection{
+			Client:        FromSSHContext(c.ctx),
+			ClientVersion: c.ctx.ClientVersion(),
+			Channels:      make([]Channel, 0, len(c.channels)),
+		}
+		for _, ch := range c.channels {
+			conn.Channels = append(conn.Channels, *ch.Channel)
+		}
+		ret = append(ret, conn)
+	}
+
+	slices.SortFunc(ret, func(a, b Connection) int {
+		return a.Client.CreatedAt().Compare(b.Client.CreatedAt())
+	})
+	return ret
+}
+
+// AddChannel registers a channel opened by the session until RemoveChannel, close closes the channel.
+func (r *Registry) AddChannel(sessionID string, ch *Channel, close func()) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if c, ok := r.conns[sessionID]; ok {
+		c.channels = append(c.channels, openChannel{Channel: ch, close: close})
+	}
+}
+
+// RemoveChannel forgets a closed channel of the session.
+func (r *Registry) RemoveChannel(sessionID string, ch *Channel) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if c, ok := r.conns[sessionID]; ok {
+		c.channels = slices.DeleteFunc(c.channels, func(v openChannel) bool {
+			return v.Channel == ch
+		})
+	}
+}
+
+// CloseChannels closes channels of the session that are no longer allowed and returns them, oldest first.
+// Closed channels are forgotten once their handler finishes.
+func (r *Registry) CloseChannels(sessionID string, allowed func(Channel) bool) []Channel {
+	var closing []openChannel
+
+	r.m.Lock()
+	if c, ok := r.conns[sessionID]; ok {
+		for _, ch := range c.channels {
+			if !allowed(*ch.Channel) {
+				closing = append(closing, ch)
+			}
+		}
+	}
+	r.m.Unlock()
+
+	ret := make([]Channel, 0, len(closing))
+	for _, ch := range closing {
+		ch.close()
+		ret = append(ret, *ch.Channel)
+	}
+	return ret
+}
+
+// Disconnect closes the connection of the context, if its handshake is complete.
+func Disconnect(ctx ssh.Context) bool {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,206 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"gosshpuppet/internal/audit"
+	"gosshpuppet/internal/callback"
+	"gosshpuppet/internal/client"
+	"gosshpuppet/internal/config"
+	"gosshpuppet/internal/puppet"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// kickedDoc is a closed connection or puppet forward of the kick documents
+type kickedDoc struct {
+	Session     string `json:"session" yaml:"session"`
+	Kind        string `json:"kind" yaml:"kind"`
+	Name        string `json:"name" yaml:"name"`
+	Remote      string `json:"remote" yaml:"remote"`
+	ServicePort uint32 `json:"service_port,omitempty" yaml:"service_port,omitempty"` // only a forward is closed if set
+}
+
+// kicker closes connections and puppet forwards on behalf of an admin
+type kicker struct {
+	logger   *slog.Logger
+	registry *client.Registry
+	forwards callback.ForwardRevoker
+	auditLog *audit.Log
+
+	by     string // admin name
+	kicked []kickedDoc
+}
+
+// connection closes the connection of the session
+func (k *kicker) connection(ctx ssh.Context) {
+	cli := client.FromSSHContext(ctx)
+	if !client.Disconnect(ctx) {
+		return
+	}
+
+	k.record(kickedDoc{
+		Session: cli.SessionID(),
+		Kind:    cli.Kind().String(),
+		Name:    cli.Name(),
+		Remote:  cli.Remote(),
+	})
+}
+
+// forward closes the puppet session forward of the service port, the connection is kept
+func (k *kicker) forward(ps puppet.PuppetSession) {
+	if !k.forwards.CancelForward(ps.SessionID, ps.ServicePort) {
+		return
+	}
+
+	k.record(kickedDoc{
+		Session:     ps.SessionID,
+		Kind:        client.ClientPuppet.String(),
+		Name:        ps.Name,
+		Remote:      ps.Remote,
+		ServicePort: ps.ServicePort,
+	})
+}
+
+func (k *kicker) record(d kickedDoc) {
+	k.kicked = append(k.kicked, d)
+
+	e := audit.Event{
+		Event:       audit.EventKick,
+		User:        k.by,
+		Kind:        d.Kind,
+		Remote:      d.Remote,
+		Session:     d.Session,
+		Target:      d.Name,
+		ServicePort: d.ServicePort,
+	}
+	if d.Kind == client.ClientPuppet.String() {
+		e.Puppet = d.Name
+	}
+	k.auditLog.Record(e)
+
+	logger := k.logger.With("by", k.by, "kind", d.Kind, "name", d.Name, "session", d.Session, "remote", d.Remote)
+	if d.ServicePort != 0 {
+		logger.Info(fmt.Sprintf("Puppet forward %s:%d is kicked", d.Name, d.ServicePort))
+	} else {
+		logger.Info("Session is kicked")
+	}
+}
+
+func (k *kicker) write(o *output) {
+	doc := struct {
+		Kicked []kickedDoc `json:"kicked" yaml:"kicked"`
+	}{make([]kickedDoc, 0, len(k.kicked))}
+
+	csvRows := make([][]string, 0, len(k.kicked))
+
+	for _, d := range k.kicked {
+		doc.Kicked = append(doc.Kicked, d)
+
+		servicePort := ""
+		if d.ServicePort != 0 {
+			servicePort = strconv.FormatUint(uint64(d.ServicePort), 10)
+		}
+		csvRows = append(csvRows, []string{d.Session, d.Kind, d.Name, d.Remote, servicePort})
+	}
+
+	o.write(doc, []string{"session", "kind", "name", "remote", "service_port"}, csvRows, func(w io.Writer) {
+		for _, d := range k.kicked {
+			if d.ServicePort != 0 {
+				fmt.Fprintf(w, "Kicked %s:%d of session %s (%s)\n", d.Name, d.ServicePort, shortSessionID(d.Session), d.Remote)
+			} else {
+				fmt.Fprintf(w, "Kicked %s %s session %s (%s)\n", d.Kind, d.Name, shortSessionID(d.Session), d.Remote)
+			}
+		}
+	})
+}
+
+// adminKick closes every connection of the puppet, or only its forwards of the service
+func adminKick(o *output, k *kicker, pm *puppet.Manager, ac *config.AccessConfigHolder, args []string) {
+	if len(args) != 1 {
+		o.fail("", kickUsage)
+		return
+	}
+
+	name, service, withService := strings.Cut(args[0], ":")
+
+	var servicePort uint32
+	if withService {
+		var ok bool
+		if servicePort, ok = serviceByName(ac.Load(), service); !ok {
+			o.fail("Unknown service", "")
+			return
+		}
+	}
+
+	services, ok := pm.Puppets()[name]
+	if !ok {
+		o.fail("Puppet not found", "")
+		return
+	}
+
+	if withService {
+		sessions, ok := services[servicePort]
+		if !ok {
+			o.fail("Puppet service not found", "")
+			return
+		}
+		for _, ps := range sessions {
+			k.forward(ps)
+		}
+		k.write(o)
+		return
+	}
+
+	var sessionIDs []string
+	for _, sessions := range services {
+		for _, ps := range sessions {
+			sessionIDs = append(sessionIDs, ps.SessionID)
+		}
+	}
+
+	for _, sctx := range k.registry.Connections() {
+		if slices.Contains(sessionIDs, sctx.SessionID()) {
+			k.connection(sctx)
+		}
+	}
+	k.write(o)
+}
+
+// adminKickSession closes the connection of a puppet or admin session, the ID may be abbreviated as shown by ls -l
+func adminKickSession(ctx context.Context, o *output, k *kicker, args []string) {
+	if len(args) != 1 || args[0] == "" {
+		o.fail("", kickSessionUsage)
+		return
+	}
+
+	var matches []ssh.Context
+	for _, sctx := range k.registry.Connections() {
+		if strings.HasPrefix(sctx.SessionID(), args[0]) {
+			matches = append(matches, sctx)
+		}
+	}
+
+	switch {
+	case len(matches) == 0:
+		o.fail("Session not found", "")
+		return
+	case len(matches) > 1:
+		o.fail("Session ID is ambiguous", "")
+		return
+	}
+
+	// the reply would be lost
+	if own, _ := ctx.Value(ssh.ContextKeySessionID).(string); matches[0].SessionID() == own {
+		o.fail("Cannot kick the own session", "")
+		return
+	}
+
+	k.connection(matches[0])
+	k.write(o)
+}
@@ -0,0 +1,111 @@
+package command
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gosshpuppet/internal/callback"
+	"io"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatYAML  = "yaml"
+	FormatCSV   = "csv"
+)
+
+var formats = []string{FormatTable, FormatJSON, FormatYAML, FormatCSV}
+
+// parseFormat takes the global --format option out of the arguments, table by default.
+// It may follow the command, ssh takes leading dashes after the destination as its own options.
+func parseFormat(args []string) (string, []string, error) {
+	format := FormatTable
+	rest := make([]string, 0, len(args))
+
+	for i := 0; i < len(args); i++ {
+		var v string
+		switch {
+		case args[i] == "--format" || args[i] == "-format":
+			if i+1 == len(args) {
+				return "", nil, fmt.Errorf("%s requires %s", args[i], strings.Join(formats, "|"))
+			}
+			i++
+			v = args[i]
+		case strings.HasPrefix(args[i], "--format="):
+			v = strings.TrimPrefix(args[i], "--format=")
+		case strings.HasPrefix(args[i], "-format="):
+			v = strings.TrimPrefix(args[i], "-format=")
+		default:
+			rest = append(rest, args[i])
+			continue
+		}
+
+		format = strings.ToLower(v)
+		if !slices.Contains(formats, format) {
+			return "", nil, fmt.Errorf("unknown format %q, expected %s", v, strings.Join(formats, ", "))
+		}
+	}
+
+	return format, rest, nil
+}
+
+// output writes command results in the requested format.
+// json and yaml get a document, csv a header with rows and table the human-readable text.
+type output struct {
+	w      io.Writer
+	format string
+
+	err error // set once a failure is written, the command exits with a non-zero status
+}
+
+// errorDoc is the document of a failed command
+type errorDoc struct {
+	Error string `json:"error" yaml:"error"`
+	Usage string `json:"usage,omitempty" yaml:"usage,omitempty"`
+}
+
+// write writes the result of a command, table prints it for humans
+func (o *output) write(doc any, csvHeader []string, csvRows [][]string, table func(w io.Writer)) {
+	switch o.format {
+	case FormatJSON:
+		enc := json.NewEncoder(o.w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(doc)
+	case FormatYAML:
+		enc := yaml.NewEncoder(o.w)
+		enc.SetIndent(2)
+		enc.Encode(doc)
+		enc.Close()
+	case FormatCSV:
+		cw := csv.NewWriter(o.w)
+		cw.Write(csvHeader)
+		cw.WriteAll(csvRows)
+	default:
+		table(o.w)
+	}
+}
+
+// fail writes a failed command result, usage is the command synopsis if the arguments are wrong
+func (o *output) fail(msg, usage string) {
+	doc := errorDoc{Error: msg, Usage: usage}
+	if doc.Error == "" {
+		doc.Error = "invalid arguments"
+	}
+	o.err = fmt.Errorf("%w: %s", callback.ErrCommandFailed, doc.Error)
+
+	o.write(doc, []string{"error", "usage"}, [][]string{{doc.Error, usage}}, func(w io.Writer) {
+		if msg != "" {
+			fmt.Fprintln(w, msg)
+		}
+		if usage != "" {
+			fmt.Fprintln(w, "Usage:", usage)
+		}
+	})
+}
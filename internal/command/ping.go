@@ -0,0 +1,277 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"gosshpuppet/internal/audit"
+	"gosshpuppet/internal/client"
+	"gosshpuppet/internal/config"
+	"gosshpuppet/internal/grant"
+	"gosshpuppet/internal/puppet"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	pingTimeout   = 5 * time.Second
+	bannerTimeout = 2 * time.Second // a silent service may be open but send no banner
+	maxBannerLen  = 200
+)
+
+// ping statuses of a service
+const (
+	pingReachable   = "reachable"    // the service sent data
+	pingOpenNoData  = "open_no_data" // the tunnel stayed open but nothing was received, the puppet may not have connected yet
+	pingUnreachable = "unreachable"  // the tunnel was closed, the puppet failed to connect to its service
+)
+
+// httpServices are probed with a request, other services are expected to send a banner like SSH-2.0-...
+var httpServices = struct {
+	names []string
+	ports []uint32
+}{
+	names: []string{"http", "web"},
+	ports: []uint32{80, 8080},
+}
+
+// pingDoc is a probed puppet service of the ping document
+type pingDoc struct {
+	Puppet      string `json:"puppet" yaml:"puppet"`
+	Service     string `json:"service" yaml:"service"` // empty if not configured
+	ServicePort uint32 `json:"service_port" yaml:"service_port"`
+	Session     string `json:"session" yaml:"session"` // probed puppet session, the newest one
+
+	TunnelRTT   float64 `json:"tunnel_rtt_seconds" yaml:"tunnel_rtt_seconds"` // keepalive round trip over the puppet connection
+	TunnelError string  `json:"tunnel_error,omitempty" yaml:"tunnel_error,omitempty"`
+
+	Status       string  `json:"status" yaml:"status"`                     // reachable, open_no_data or unreachable
+	ResponseTime float64 `json:"response_seconds" yaml:"response_seconds"` // until the first line of the service, 0 if none
+	Banner       string  `json:"banner" yaml:"banner"`                     // first line of the service
+	Error        string  `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// adminPing probes the puppet services through their tunnels, every service the admin is able to use if not given
+func adminPing(ctx context.Context, o *output, pm *puppet.Manager, ac *config.AccessConfigHolder, grants *grant.Store, auditLog *audit.Log, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		o.fail("", pingUsage)
+		return
+	}
+
+	cli := client.FromSSHContext(ctx)
+	accessConfig := ac.Load()
+	name := args[0]
+
+	var ports []uint32
+	if len(args) == 2 {
+		port, ok := serviceByName(accessConfig, args[1])
+		if !ok {
+			o.fail("Unknown service", "")
+			return
+		}
+		ports = append(ports, port)
+	} else {
+		for port := range accessConfig.Services {
+			ports = append(ports, port)
+		}
+		slices.Sort(ports)
+	}
+
+	// access is checked like for channels and before the puppet is looked up, so its existence is not revealed
+	ports = slices.DeleteFunc(ports, func(port uint32) bool {
+		return !adminCanUse(ctx, accessConfig, grants, cli.Name(), name, port) || !accessConfig.AdminKeyPermitsOpen(cli.Name(), cli.Key(), name, port)
+	})
+	if len(ports) == 0 {
+		o.fail("Access to the puppet is disallowed", "")
+		return
+	}
+	if open, _ := accessConfig.ChannelWindow(cli.Name(), name, time.Now()); !open {
+		o.fail("Access to the puppet is disallowed at this time", "")
+		return
+	}
+
+	services, ok := pm.Puppets()[name]
+	if !ok {
+		o.fail("Puppet not found", "")
+		return
+	}
+
+	// probe only the services the puppet exposes
+	ports = slices.DeleteFunc(ports, func(port uint32) bool {
+		_, ok := services[port]
+		return !ok
+	})
+	if len(ports) == 0 {
+		o.fail("Puppet service not found", "")
+		return
+	}
+
+	results := make([]pingDoc, len(ports))
+
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = pingService(ctx, pm, accessConfig, name, port)
+		}()
+	}
+	wg.Wait()
+
+	for _, r := range results {
+		recordPing(auditLog, cli, r)
+	}
+
+	doc := struct {
+		Results []pingDoc `json:"results" yaml:"results"`
+	}{results}
+
+	csvRows := make([][]string, 0, len(results))
+	tableRows := make([][]string, 0, len(results))
+
+	for _, r := range results {
+		csvRows = append(csvRows, []string{
+			r.Puppet,
+			r.Service,
+			strconv.FormatUint(uint64(r.ServicePort), 10),
+			r.Session,
+			strconv.FormatFloat(r.TunnelRTT, 'f', -1, 64),
+			r.TunnelError,
+			r.Status,
+			strconv.FormatFloat(r.ResponseTime, 'f', -1, 64),
+			r.Banner,
+			r.Error,
+		})
+
+		tunnel := seconds(r.TunnelRTT)
+		if r.TunnelError != "" {
+			tunnel = "error"
+		}
+		service := r.Status
+		if r.Error != "" {
+			service = r.Error
+		}
+		response := "-"
+		if r.ResponseTime > 0 {
+			response = seconds(r.ResponseTime)
+		}
+
+		tableRows = append(tableRows, []string{
+			r.Puppet,
+			serviceName(accessConfig, r.ServicePort),
+			tunnel,
+			service,
+			response,
+			r.Banner,
+		})
+	}
+
+	csvHeader := []string{"puppet", "service", "service_port", "session", "tunnel_rtt_seconds", "tunnel_error", "status", "response_seconds", "banner", "error"}
+
+	o.write(doc, csvHeader, csvRows, func(w io.Writer) {
+		printTable(w, "  ", []string{"PUPPET", "SERVICE", "TUNNEL", "STATUS", "RESPONSE", "BANNER"}, tableRows)
+	})
+}
+
+func seconds(v float64) string {
+	return time.Duration(v * float64(time.Second)).Round(10 * time.Microsecond).String()
+}
+
+// pingService measures the tunnel round trip and dials the service through the tunnel, reading its first line
+func pingService(ctx context.Context, pm *puppet.Manager, cfg *config.AccessConfig, name string, port uint32) pingDoc {
+	r := pingDoc{
+		Puppet:      name,
+		Service:     cfg.Services[port],
+		ServicePort: port,
+		Status:      pingUnreachable,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	sessionID, rtt, err := pm.Ping(ctx, name, port)
+	r.Session = sessionID
+	if err != nil {
+		r.TunnelError = err.Error()
+	} else {
+		r.TunnelRTT = rtt.Seconds()
+	}
+
+	addr, network, ok := pm.PuppetAddress(name, port)
+	if !ok {
+		r.Error = puppet.ErrPuppetNotFound.Error()
+		return r
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		r.Error = fmt.Sprintf("dialing tunnel: %s", err)
+		return r
+	}
+	defer conn.Close()
+
+	began := time.Now()
+	conn.SetDeadline(began.Add(bannerTimeout))
+
+	if slices.Contains(httpServices.names, r.Service) || slices.Contains(httpServices.ports, port) {
+		fmt.Fprintf(conn, "HEAD / HTTP/1.0\r\nHost: %s\r\n\r\n", name)
+	}
+
+	// the proxy closes the connection at once if the puppet fails to connect to its service,
+	// a silent one does not tell whether the puppet has connected yet
+	line, err := bufio.NewReader(io.LimitReader(conn, maxBannerLen)).ReadString('\n')
+	var netErr net.Error
+	switch {
+	case line != "":
+		r.Status = pingReachable
+		r.ResponseTime = time.Since(began).Seconds()
+		r.Banner = sanitizeBanner(line)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		r.Status = pingOpenNoData
+	}
+
+	return r
+}
+
+// recordPing audits a probe like a channel of the admin to the puppet service
+func recordPing(auditLog *audit.Log, cli *client.Client, r pingDoc) {
+	e := audit.Event{
+		Event:         audit.EventPing,
+		User:          cli.Name(),
+		Kind:          cli.Kind().String(),
+		Remote:        cli.Remote(),
+		Session:       cli.SessionID(),
+		Fingerprint:   cli.KeyFingerprint(),
+		Puppet:        r.Puppet,
+		ServicePort:   r.ServicePort,
+		PuppetSession: r.Session,
+		Result:        "success",
+	}
+
+	switch {
+	case r.Error != "":
+		e.Result, e.Reason = "failure", r.Error
+	case r.Status != pingReachable:
+		e.Result, e.Reason = "failure", r.Status
+	}
+
+	auditLog.Record(e)
+}
+
+// sanitizeBanner trims the line and drops control characters
+func sanitizeBanner(line string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(line))
+}
@@ -0,0 +1,119 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"gosshpuppet/internal/client"
+	"gosshpuppet/internal/config"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// connectionDoc is a connection of the who document
+type connectionDoc struct {
+	Session       string       `json:"session" yaml:"session"`
+	Kind          string       `json:"kind" yaml:"kind"`
+	Name          string       `json:"name" yaml:"name"`
+	Remote        string       `json:"remote" yaml:"remote"`
+	ClientVersion string       `json:"client_version" yaml:"client_version"`
+	ConnectedAt   time.Time    `json:"connected_at" yaml:"connected_at"`
+	Current       bool         `json:"current" yaml:"current"` // the connection running the command
+	Channels      []channelDoc `json:"channels" yaml:"channels"`
+}
+
+type channelDoc struct {
+	Puppet        string    `json:"puppet" yaml:"puppet"`
+	Service       string    `json:"service" yaml:"service"` // empty if not configured
+	ServicePort   uint32    `json:"service_port" yaml:"service_port"`
+	PuppetSession string    `json:"puppet_session" yaml:"puppet_session"`
+	OpenedAt      time.Time `json:"opened_at" yaml:"opened_at"`
+}
+
+// adminPrintConnections prints live puppet and admin connections with channels they opened, oldest first
+func adminPrintConnections(ctx context.Context, o *output, registry *client.Registry, ac *config.AccessConfigHolder) {
+	accessConfig := ac.Load()
+	own, _ := ctx.Value(ssh.ContextKeySessionID).(string)
+
+	conns := registry.List()
+
+	doc := struct {
+		Connections []connectionDoc `json:"connections" yaml:"connections"`
+	}{make([]connectionDoc, 0, len(conns))}
+
+	csvRows := make([][]string, 0, len(conns))
+	tableRows := make([][]string, 0, len(conns))
+
+	now := time.Now()
+
+	for _, c := range conns {
+		cd := connectionDoc{
+			Session:       c.Client.SessionID(),
+			Kind:          c.Client.Kind().String(),
+			Name:          c.Client.Name(),
+			Remote:        c.Client.Remote(),
+			ClientVersion: c.ClientVersion,
+			ConnectedAt:   c.Client.CreatedAt(),
+			Current:       c.Client.SessionID() == own,
+			Channels:      make([]channelDoc, 0, len(c.Channels)),
+		}
+
+		// channel targets, counted like replicas by ls
+		var (
+			targets []string
+			counts  = make(map[string]int)
+		)
+		for _, ch := range c.Channels {
+			cd.Channels = append(cd.Channels, channelDoc{
+				Puppet:        ch.Puppet,
+				Service:       accessConfig.Services[ch.ServicePort],
+				ServicePort:   ch.ServicePort,
+				PuppetSession: ch.PuppetSession,
+				OpenedAt:      ch.OpenedAt,
+			})
+
+			target := ch.Puppet + ":" + serviceName(accessConfig, ch.ServicePort)
+			if counts[target] == 0 {
+				targets = append(targets, target)
+			}
+			counts[target]++
+		}
+		for i, v := range targets {
+			if n := counts[v]; n > 1 {
+				targets[i] += fmt.Sprintf("(x%d)", n)
+			}
+		}
+
+		session := shortSessionID(cd.Session)
+		if cd.Current {
+			session += "*"
+		}
+
+		doc.Connections = append(doc.Connections, cd)
+		csvRows = append(csvRows, []string{
+			cd.Session,
+			cd.Kind,
+			cd.Name,
+			cd.Remote,
+			cd.ClientVersion,
+			cd.ConnectedAt.Format(time.RFC3339),
+			strconv.Itoa(len(cd.Channels)),
+		})
+		tableRows = append(tableRows, []string{
+			session,
+			cd.Kind,
+			cd.Name,
+			cd.Remote,
+			cd.ConnectedAt.Format(time.RFC3339),
+			now.Sub(cd.ConnectedAt).Round(time.Second).String(),
+			strings.Join(targets, ","),
+		})
+	}
+
+	o.write(doc, []string{"session", "kind", "name", "remote", "client_version", "connected_at", "channels"}, csvRows, func(w io.Writer) {
+		printTable(w, "  ", []string{"SESSION", "KIND", "NAME", "REMOTE", "SINCE", "UPTIME", "CHANNELS"}, tableRows)
+	})
+}
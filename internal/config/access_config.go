@@ -1,13 +1,17 @@
 package config
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"io"
+	"net"
+	"net/netip"
 	"regexp"
+	"slices"
+	"strings"
 	"sync/atomic"
 
 	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
 
@@ -15,47 +19,152 @@ var DefaultServicePorts = map[uint32]string{
 	22: "ssh",
 }
 
+const (
+	FingerprintSubexp    = "fingerprint" // puppet regexp group binding the name to a key fingerprint
+	MinFingerprintPrefix = 8
+)
+
+var (
+	ErrUnknownKey          = errors.New("unknown key")
+	ErrPuppetImpersonation = errors.New("key is bound to another puppet name")
+)
+
 type AccessConfigHolder struct {
 	atomic.Pointer[AccessConfig]
 }
 
 type AccessConfig struct {
-	Admins   map[string][]PublicKey `yaml:"admins"`
-	Puppets  []*Puppet              `yaml:"puppets"`
-	Services map[uint32]string      `yaml:"services"`
+	Admins   map[string]*Admin `yaml:"admins"`
+	Puppets  []*Puppet         `yaml:"puppets"`
+	Services map[uint32]string `yaml:"services"`
+
+	AllowedSources []string `yaml:"allowed_sources"` // client addresses/CIDRs, any if empty, admins and puppets may override
+
+	CertificateAuthorities CertificateAuthorities `yaml:"certificate_authorities"`
+
+	Roles map[string]*Role `yaml:"roles"` // admins restrictions, admins without a role may access everything
+
+	Schedules map[string]*Schedule `yaml:"schedules"` // access windows admins and puppets may refer to
+
+	Include []string `yaml:"include"` // fragment file globs, relative to the including file, see LoadAccessConfig
+
+	sources []netip.Prefix
 }
 
-type Puppet struct {
-	Regexp string      `yaml:"regexp"` // regexp to match puppet name (lowercase!)
-	Keys   []PublicKey `yaml:"keys"`
+// Admin is a list of admin keys, or a mapping with the keys and allowed sources
+type Admin struct {
+	Keys           PublicKeys `yaml:"keys"`
+	AllowedSources []string   `yaml:"allowed_sources"` // client addresses/CIDRs, overrides global allowed sources if set
+	Schedule       string     `yaml:"schedule"`        // schedule name, channels are allowed only within its windows
 
-	re *regexp.Regexp
+	sources []netip.Prefix
 }
 
-func ParseAccessConfig(_ context.Context, r io.Reader) (*AccessConfig, error) {
-	var c AccessConfig
-	if err := yaml.NewDecoder(r).Decode(&c); err != nil {
-		return nil, fmt.Errorf("decoding yaml: %w", err)
+func (a *Admin) schedule() string {
+	if a == nil {
+		return ""
 	}
+	return a.Schedule
+}
+
+// UnmarshalYAML accepts either a list of keys or a mapping
+func (a *Admin) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		return value.Decode(&a.Keys)
+	}
+
+	type plain Admin
+	return value.Decode((*plain)(a))
+}
+
+type Puppet struct {
+	Regexp   string     `yaml:"regexp"` // regexp to match puppet name (lowercase!)
+	Keys     PublicKeys `yaml:"keys"`
+	Services []uint32   `yaml:"services"` // allowed service ports, narrows global services if set
+	Pin      bool       `yaml:"pin"`      // every key must be bound to the name, see CheckPuppet
+
+	OnDuplicate DuplicatePolicy `yaml:"on_duplicate"` // same name and service registration policy, replace by default
+	Balance     BalanceStrategy `yaml:"balance"`      // session selection among kept duplicates, newest by default
+	Failover    bool            `yaml:"failover"`     // try other kept duplicates on dial error
 
+	AllowedSources []string `yaml:"allowed_sources"` // client addresses/CIDRs, overrides global allowed sources if set
+	Schedule       string   `yaml:"schedule"`        // schedule name, channels are allowed only within its windows
+
+	re      *regexp.Regexp
+	sources []netip.Prefix
+}
+
+// prepareAccessConfig validates the config, compiles its regexps and parses allowed sources
+func prepareAccessConfig(c *AccessConfig) (*AccessConfig, error) {
 	if err := c.Validate(); err != nil {
 		return nil, fmt.Errorf("validating config: %w", err)
 	}
 
+	if err := c.readKeysFiles(); err != nil {
+		return nil, err
+	}
+
+	sources, err := parseSources(c.AllowedSources)
+	if err != nil {
+		return nil, fmt.Errorf("allowed sources: %w", err)
+	}
+	c.sources = sources
+
+	for name, a := range c.Admins {
+		if a == nil {
+			continue
+		}
+		sources, err := parseSources(a.AllowedSources)
+		if err != nil {
+			return nil, fmt.Errorf("admin %q allowed sources: %w", name, err)
+		}
+		a.sources = sources
+	}
+
 	for _, v := range c.Puppets {
 		r, err := regexp.Compile(v.Regexp)
 		if err != nil {
 			return nil, fmt.Errorf("compiling puppet regexp %q: %w", v.Regexp, err)
 		}
 		v.re = r
+
+		sources, err := parseSources(v.AllowedSources)
+		if err != nil {
+			return nil, fmt.Errorf("puppet %q allowed sources: %w", v.Regexp, err)
+		}
+		v.sources = sources
+
+		if v.Pin && r.SubexpIndex(FingerprintSubexp) < 0 {
+			for _, k := range v.Keys {
+				if k.Name == "" {
+					return nil, fmt.Errorf("puppet %q is pinned, but has neither %q group nor key names", v.Regexp, FingerprintSubexp)
+				}
+			}
+		}
 	}
 
-	return &c, nil
+	for name, s := range c.Schedules {
+		if err := s.compile(); err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", name, err)
+		}
+	}
+
+	for roleName, role := range c.Roles {
+		for _, v := range role.Rules {
+			r, err := regexp.Compile(v.Puppets)
+			if err != nil {
+				return nil, fmt.Errorf("compiling role %q puppets regexp %q: %w", roleName, v.Puppets, err)
+			}
+			v.re = r
+		}
+	}
+
+	return c, nil
 }
 
 func (c *AccessConfig) Validate() error {
-	if len(c.Admins) == 0 {
-		return fmt.Errorf("no admins defined")
+	if len(c.Admins) == 0 && len(c.CertificateAuthorities.Admins) == 0 {
+		return fmt.Errorf("no admins or admin certificate authorities defined")
 	}
 
 	if len(c.Services) == 0 {
@@ -66,36 +175,292 @@ func (c *AccessConfig) Validate() error {
 		c.Services = m
 	}
 
+	for _, pu := range c.Puppets {
+		if pu == nil {
+			return fmt.Errorf("puppet entry is empty")
+		}
+		if err := pu.OnDuplicate.Validate(); err != nil {
+			return fmt.Errorf("puppet %q: %w", pu.Regexp, err)
+		}
+		if err := pu.Balance.Validate(); err != nil {
+			return fmt.Errorf("puppet %q: %w", pu.Regexp, err)
+		}
+		for _, port := range pu.Services {
+			if _, ok := c.Services[port]; !ok {
+				return fmt.Errorf("puppet %q refers to unknown service port %d", pu.Regexp, port)
+			}
+		}
+		if _, ok := c.Schedules[pu.Schedule]; pu.Schedule != "" && !ok {
+			return fmt.Errorf("puppet %q refers to unknown schedule %q", pu.Regexp, pu.Schedule)
+		}
+	}
+
+	for name, a := range c.Admins {
+		if _, ok := c.Schedules[a.schedule()]; a.schedule() != "" && !ok {
+			return fmt.Errorf("admin %q refers to unknown schedule %q", name, a.Schedule)
+		}
+	}
+
+	for name, s := range c.Schedules {
+		if s == nil {
+			return fmt.Errorf("schedule %q is empty", name)
+		}
+		for _, w := range s.Windows {
+			if w == nil {
+				return fmt.Errorf("schedule %q has an empty window", name)
+			}
+		}
+	}
+
+	for roleName, role := range c.Roles {
+		if role == nil {
+			return fmt.Errorf("role %q is empty", roleName)
+		}
+		if len(role.Admins) == 0 {
+			return fmt.Errorf("role %q has no admins", roleName)
+		}
+		// a misspelled admin would not be restricted at all
+		for _, name := range role.Admins {
+			if _, ok := c.Admins[name]; !ok {
+				return fmt.Errorf("role %q refers to unknown admin %q", roleName, name)
+			}
+		}
+		for _, rule := range role.Rules {
+			if rule == nil {
+				return fmt.Errorf("role %q has an empty rule", roleName)
+			}
+			for _, port := range rule.Services {
+				if _, ok := c.Services[port]; !ok {
+					return fmt.Errorf("role %q refers to unknown service port %d", roleName, port)
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
-func (c *AccessConfig) IsAdmin(name string, key ssh.PublicKey) bool {
-	keys, ok := c.Admins[name]
-	if !ok {
-		return false
+// CheckAdmin checks the key is allowed to identify as the named admin connecting from the remote address.
+// ErrSourceNotAllowed is returned if the key is known, but the remote address is not in the allowed sources.
+// ErrKeyRestricted is returned if the key is known, but its options do not allow the connection.
+func (c *AccessConfig) CheckAdmin(name string, remote net.Addr, key ssh.PublicKey) error {
+	k := c.adminKey(name, key)
+	if k == nil {
+		return ErrUnknownKey
+	}
+	if err := c.checkAdminSource(name, remote); err != nil {
+		return err
 	}
+	return k.checkOptions(remote)
+}
 
-	for _, k := range keys {
+func (c *AccessConfig) adminKey(name string, key ssh.PublicKey) *PublicKey {
+	a := c.Admins[name]
+	if a == nil {
+		return nil
+	}
+	for i, k := range a.Keys {
 		if ssh.KeysEqual(k, key) {
-			return true
+			return &a.Keys[i]
 		}
 	}
+	return nil
+}
 
-	return false
+// CheckPuppet checks the key is allowed to identify as the named puppet connecting from the remote address.
+//
+// A key with a name is bound to that name only. Keys of a pinned puppet entry without a name are bound
+// through the regexp group named "fingerprint": its match must be a prefix of the key hex SHA256 fingerprint.
+// ErrPuppetImpersonation is returned if the key is known, but bound to another name.
+// ErrSourceNotAllowed is returned if the key is known, but the remote address is not in the allowed sources of its entry.
+// ErrKeyRestricted is returned if the key is known, but its options do not allow the connection.
+func (c *AccessConfig) CheckPuppet(name string, remote net.Addr, key ssh.PublicKey) error {
+	pu, k, err := c.puppetKey(name, key)
+	if err != nil {
+		return err
+	}
+	if err := pu.checkSource(c, remote); err != nil {
+		return err
+	}
+	return k.checkOptions(remote)
+}
+
+// puppetKey finds the key allowed to identify as the named puppet and the entry it belongs to
+func (c *AccessConfig) puppetKey(name string, key ssh.PublicKey) (*Puppet, *PublicKey, error) {
+	var impersonation bool
+
+	for _, pu := range c.Puppets {
+		match := pu.re.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+
+		for i, k := range pu.Keys {
+			if !ssh.KeysEqual(k, key) {
+				continue
+			}
+
+			switch {
+			case k.Name != "":
+				if k.Name == name {
+					return pu, &pu.Keys[i], nil
+				}
+			case pu.Pin:
+				if fingerprintMatches(pu.re, match, key) {
+					return pu, &pu.Keys[i], nil
+				}
+			default:
+				return pu, &pu.Keys[i], nil
+			}
+
+			impersonation = true
+		}
+	}
+
+	if impersonation {
+		return nil, nil, ErrPuppetImpersonation
+	}
+	return nil, nil, ErrUnknownKey
+}
+
+// AdminKeyPermitsOpen reports whether permitopen options of the admin key allow connecting to the puppet service.
+// Keys without the option, as well as certificates, are not restricted.
+func (c *AccessConfig) AdminKeyPermitsOpen(name string, key ssh.PublicKey, puppet string, servicePort uint32) bool {
+	k := c.adminKey(name, key)
+	return k == nil || k.permitsOpen(puppet, servicePort)
+}
+
+// PuppetKeyPermitsListen reports whether permitlisten options of the puppet key allow exposing the service.
+// Keys without the option, as well as certificates, are not restricted.
+func (c *AccessConfig) PuppetKeyPermitsListen(name string, key ssh.PublicKey, servicePort uint32) bool {
+	_, k, err := c.puppetKey(name, key)
+	return err != nil || k.permitsListen(servicePort)
+}
+
+// KeysFiles returns keys files the config refers to.
+func (c *AccessConfig) KeysFiles() []string {
+	var files []string
+
+	c.eachKeys(func(keys *PublicKeys) {
+		for _, k := range *keys {
+			if k.File != "" && !slices.Contains(files, k.File) {
+				files = append(files, k.File)
+			}
+		}
+	})
+
+	slices.Sort(files)
+	return files
+}
+
+// resolveKeysFiles makes relative keys file paths relative to dir, the directory of the config file
+func (c *AccessConfig) resolveKeysFiles(dir string) {
+	c.eachKeys(func(keys *PublicKeys) {
+		keys.resolve(dir)
+	})
+}
+
+// readKeysFiles reads keys of the keys files the config refers to
+func (c *AccessConfig) readKeysFiles() error {
+	var err error
+
+	c.eachKeys(func(keys *PublicKeys) {
+		if err != nil {
+			return
+		}
+		*keys, err = keys.read()
+	})
+
+	return err
+}
+
+// eachKeys calls fn with keys of every admin and puppet entry
+func (c *AccessConfig) eachKeys(fn func(keys *PublicKeys)) {
+	for _, a := range c.Admins {
+		if a != nil {
+			fn(&a.Keys)
+		}
+	}
+	for _, pu := range c.Puppets {
+		if pu != nil {
+			fn(&pu.Keys)
+		}
+	}
 }
 
-func (c *AccessConfig) IsPuppet(name string, key ssh.PublicKey) bool {
+// PuppetPinned reports whether a puppet entry matching the name is pinned.
+func (c *AccessConfig) PuppetPinned(name string) bool {
 	for _, pu := range c.Puppets {
-		if !pu.re.MatchString(name) {
+		if pu.Pin && pu.re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func fingerprintMatches(re *regexp.Regexp, match []string, key ssh.PublicKey) bool {
+	i := re.SubexpIndex(FingerprintSubexp)
+	if i < 0 || len(match[i]) < MinFingerprintPrefix {
+		return false
+	}
+	return strings.HasPrefix(KeyFingerprintHex(key), match[i])
+}
+
+// PuppetServiceAllowed reports whether the puppet is allowed to expose the service.
+// The service must be defined globally and, if the entry accepting the key or certificate narrows services, listed by it.
+// Other entries matching the name do not widen the services.
+func (c *AccessConfig) PuppetServiceAllowed(name string, remote net.Addr, key ssh.PublicKey, servicePort uint32) bool {
+	if _, ok := c.Services[servicePort]; !ok {
+		return false
+	}
+
+	var pu *Puppet
+	if _, ok := key.(*gossh.Certificate); ok {
+		pu, _ = c.puppetCertificateEntry(name, remote)
+	} else {
+		pu, _, _ = c.puppetKey(name, key)
+	}
+
+	return pu != nil && (len(pu.Services) == 0 || slices.Contains(pu.Services, servicePort))
+}
+
+// AdminCanAccess reports whether the admin is allowed to reach the puppet service.
+// The puppet itself is not checked: its forwards are validated on registration and on config reload,
+// and it may be authorized by the key lookup rather than the config.
+func (c *AccessConfig) AdminCanAccess(admin, puppet string, servicePort uint32) bool {
+	if _, ok := c.Services[servicePort]; !ok {
+		return false
+	}
+
+	restricted := false
+
+	for _, role := range c.Roles {
+		if !slices.Contains(role.Admins, admin) {
 			continue
 		}
+		restricted = true
 
-		for _, k := range pu.Keys {
-			if ssh.KeysEqual(k, key) {
+		for _, rule := range role.Rules {
+			if rule.Allows(puppet, servicePort) {
 				return true
 			}
 		}
 	}
 
+	return !restricted
+}
+
+// AdminRestricted reports whether the admin is restricted by roles.
+func (c *AccessConfig) AdminRestricted(admin string) bool {
+	for _, role := range c.Roles {
+		if slices.Contains(role.Admins, admin) {
+			return true
+		}
+	}
 	return false
 }
+
+// CanAccess reports whether the admin is allowed to reach the puppet service according to the current config.
+func (h *AccessConfigHolder) CanAccess(admin, puppet string, servicePort uint32) bool {
+	return h.Load().AdminCanAccess(admin, puppet, servicePort)
+}
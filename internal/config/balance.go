@@ -0,0 +1,35 @@
+package config
+
+import "fmt"
+
+// BalanceStrategy defines how a session is chosen among puppet sessions sharing the same name and service.
+type BalanceStrategy string
+
+const (
+	BalanceNewest           BalanceStrategy = "newest"
+	BalanceRoundRobin       BalanceStrategy = "round-robin"
+	BalanceLeastConnections BalanceStrategy = "least-connections"
+)
+
+func (s BalanceStrategy) Validate() error {
+	switch s {
+	case "", BalanceNewest, BalanceRoundRobin, BalanceLeastConnections:
+		return nil
+	default:
+		return fmt.Errorf("unknown balance strategy %q", s)
+	}
+}
+
+// PuppetBalance returns the balance strategy and failover flag of the first puppet entry matching the name.
+func (c *AccessConfig) PuppetBalance(name string) (BalanceStrategy, bool) {
+	for _, pu := range c.Puppets {
+		if !pu.re.MatchString(name) {
+			continue
+		}
+		if pu.Balance == "" {
+			return BalanceNewest, pu.Failover
+		}
+		return pu.Balance, pu.Failover
+	}
+	return BalanceNewest, false
+}
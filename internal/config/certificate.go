@@ -0,0 +1,130 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const sourceAddressCriticalOption = "source-address"
+
+// SupportedCriticalOptions lists user certificate critical options the proxy is able to enforce.
+// Certificates carrying any other critical option are rejected.
+var SupportedCriticalOptions = []string{sourceAddressCriticalOption}
+
+type CertificateAuthorities struct {
+	Admins  []PublicKey `yaml:"admins"`  // CA keys trusted to sign admin certificates
+	Puppets []PublicKey `yaml:"puppets"` // CA keys trusted to sign puppet certificates
+}
+
+// CheckAdminCertificate validates an admin certificate presented by the named user connecting from the remote address.
+func (c *AccessConfig) CheckAdminCertificate(name string, remote net.Addr, cert *gossh.Certificate) error {
+	if err := checkCertificate(c.CertificateAuthorities.Admins, name, remote, cert); err != nil {
+		return err
+	}
+	return c.checkAdminSource(name, remote)
+}
+
+// CheckPuppetCertificate validates a puppet certificate presented by the named puppet connecting from the remote address.
+// The name must also match at least one puppet regexp whose allowed sources include the remote address.
+func (c *AccessConfig) CheckPuppetCertificate(name string, remote net.Addr, cert *gossh.Certificate) error {
+	if err := checkCertificate(c.CertificateAuthorities.Puppets, name, remote, cert); err != nil {
+		return err
+	}
+
+	_, err := c.puppetCertificateEntry(name, remote)
+	return err
+}
+
+// puppetCertificateEntry finds the first puppet entry matching the name whose allowed sources include the remote address
+func (c *AccessConfig) puppetCertificateEntry(name string, remote net.Addr) (*Puppet, error) {
+	var sourceErr error
+
+	for _, pu := range c.Puppets {
+		if !pu.re.MatchString(name) {
+			continue
+		}
+		if sourceErr = pu.checkSource(c, remote); sourceErr == nil {
+			return pu, nil
+		}
+	}
+
+	if sourceErr != nil {
+		return nil, sourceErr
+	}
+	return nil, fmt.Errorf("name %q does not match any puppet", name)
+}
+
+func checkCertificate(authorities []PublicKey, principal string, remote net.Addr, cert *gossh.Certificate) error {
+	if len(authorities) == 0 {
+		return fmt.Errorf("no certificate authorities defined")
+	}
+
+	if cert.CertType != gossh.UserCert {
+		return fmt.Errorf("certificate has type %d, expected user certificate", cert.CertType)
+	}
+
+	// An empty principals list means "any user" in terms of gossh, which is too permissive for the proxy
+	if len(cert.ValidPrincipals) == 0 {
+		return fmt.Errorf("certificate has no principals")
+	}
+
+	checker := &gossh.CertChecker{
+		SupportedCriticalOptions: SupportedCriticalOptions,
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			for _, k := range authorities {
+				if ssh.KeysEqual(k, auth) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return fmt.Errorf("certificate signed by unknown authority")
+	}
+
+	// checks validity window, principals, critical options and signature
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return err
+	}
+
+	if v, ok := cert.CriticalOptions[sourceAddressCriticalOption]; ok {
+		if err := checkSourceAddress(remote, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkSourceAddress(addr net.Addr, sourceAddrs string) error {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("remote address %v is not a TCP address", addr)
+	}
+
+	for _, v := range strings.Split(sourceAddrs, ",") {
+		if ip := net.ParseIP(v); ip != nil {
+			if ip.Equal(tcpAddr.IP) {
+				return nil
+			}
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return fmt.Errorf("parsing source address %q: %w", v, err)
+		}
+
+		if ipNet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("remote address %v is not allowed by source-address option", addr)
+}
@@ -0,0 +1,32 @@
+package config
+
+import "fmt"
+
+// DuplicatePolicy defines what happens when a puppet registers a service already registered under the same name.
+type DuplicatePolicy string
+
+const (
+	DuplicateReplace   DuplicatePolicy = "replace"    // newest session takes over, older stays connected
+	DuplicateRejectNew DuplicatePolicy = "reject-new" // newest session is rejected
+	DuplicateKickOld   DuplicatePolicy = "kick-old"   // newest session takes over, older connection is closed
+	DuplicateKeepBoth  DuplicatePolicy = "keep-both"  // all sessions are kept
+)
+
+func (p DuplicatePolicy) Validate() error {
+	switch p {
+	case "", DuplicateReplace, DuplicateRejectNew, DuplicateKickOld, DuplicateKeepBoth:
+		return nil
+	default:
+		return fmt.Errorf("unknown duplicate policy %q", p)
+	}
+}
+
+// PuppetDuplicatePolicy returns the duplicate policy of the first puppet entry matching the name and defining one.
+func (c *AccessConfig) PuppetDuplicatePolicy(name string) DuplicatePolicy {
+	for _, pu := range c.Puppets {
+		if pu.OnDuplicate != "" && pu.re.MatchString(name) {
+			return pu.OnDuplicate
+		}
+	}
+	return DuplicateReplace
+}
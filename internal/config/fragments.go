@@ -0,0 +1,189 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadAccessConfig loads the access config from a file or a directory of fragments.
+// A directory is read as *.yaml/*.yml fragments in lexical order, a file may pull fragments in by `include` globs.
+// Fragments are merged into a single config: admins, roles and schedules must be unique, service ports must be named consistently.
+// Global allowed sources and admin certificate authorities may only be set in the top file, the first one of a directory.
+func LoadAccessConfig(_ context.Context, path string) (*AccessConfig, error) {
+	files, err := AccessConfigFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newFragmentMerger()
+
+	for i, file := range files {
+		c, err := decodeFragment(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// only the top file may include fragments
+		if len(c.Include) > 0 && (i > 0 || isDir(path)) {
+			return nil, fmt.Errorf("%s: include is only allowed in the top config file", file)
+		}
+
+		// global settings widen access of everyone, so fragments may not add to them
+		if i > 0 && len(c.AllowedSources) > 0 {
+			return nil, fmt.Errorf("%s: allowed_sources is only allowed in the top config file", file)
+		}
+		if i > 0 && len(c.CertificateAuthorities.Admins) > 0 {
+			return nil, fmt.Errorf("%s: admin certificate authorities are only allowed in the top config file", file)
+		}
+
+		if err := m.merge(file, c); err != nil {
+			return nil, err
+		}
+	}
+
+	return prepareAccessConfig(&m.config)
+}
+
+// AccessConfigFiles lists the files the access config at path consists of: the file itself and its includes,
+// or fragments of the directory.
+func AccessConfigFiles(path string) ([]string, error) {
+	if isDir(path) {
+		var files []string
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			v, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, fmt.Errorf("listing %s: %w", path, err)
+			}
+			files = append(files, v...)
+		}
+		slices.Sort(files)
+
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no config fragments in %s", path)
+		}
+		return files, nil
+	}
+
+	c, err := decodeFragment(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+
+		v, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include %q: %w", path, pattern, err)
+		}
+		slices.Sort(v)
+
+		for _, file := range v {
+			if !slices.Contains(files, file) {
+				files = append(files, file)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+func decodeFragment(file string) (*AccessConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", file, err)
+	}
+	defer f.Close()
+
+	var c AccessConfig
+	if err := yaml.NewDecoder(f).Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: decoding yaml: %w", file, err)
+	}
+	c.resolveKeysFiles(filepath.Dir(file))
+
+	return &c, nil
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// fragmentMerger merges fragments, remembering where every unique entry comes from
+type fragmentMerger struct {
+	config AccessConfig
+
+	adminFiles    map[string]string
+	roleFiles     map[string]string
+	scheduleFiles map[string]string
+	serviceFiles  map[uint32]string
+}
+
+func newFragmentMerger() *fragmentMerger {
+	return &fragmentMerger{
+		config: AccessConfig{
+			Admins:    make(map[string]*Admin),
+			Services:  make(map[uint32]string),
+			Roles:     make(map[string]*Role),
+			Schedules: make(map[string]*Schedule),
+		},
+		adminFiles:    make(map[string]string),
+		roleFiles:     make(map[string]string),
+		scheduleFiles: make(map[string]string),
+		serviceFiles:  make(map[uint32]string),
+	}
+}
+
+func (m *fragmentMerger) merge(file string, c *AccessConfig) error {
+	for name, a := range c.Admins {
+		if other, ok := m.adminFiles[name]; ok {
+			return fmt.Errorf("%s: admin %q is already defined in %s", file, name, other)
+		}
+		m.adminFiles[name] = file
+		m.config.Admins[name] = a
+	}
+
+	for port, name := range c.Services {
+		if other, ok := m.serviceFiles[port]; ok {
+			if m.config.Services[port] != name {
+				return fmt.Errorf("%s: service port %d is named %q, but %q in %s", file, port, name, m.config.Services[port], other)
+			}
+			continue
+		}
+		m.serviceFiles[port] = file
+		m.config.Services[port] = name
+	}
+
+	for name, role := range c.Roles {
+		if other, ok := m.roleFiles[name]; ok {
+			return fmt.Errorf("%s: role %q is already defined in %s", file, name, other)
+		}
+		m.roleFiles[name] = file
+		m.config.Roles[name] = role
+	}
+
+	for name, s := range c.Schedules {
+		if other, ok := m.scheduleFiles[name]; ok {
+			return fmt.Errorf("%s: schedule %q is already defined in %s", file, name, other)
+		}
+		m.scheduleFiles[name] = file
+		m.config.Schedules[name] = s
+	}
+
+	m.config.Puppets = append(m.config.Puppets, c.Puppets...)
+	m.config.AllowedSources = append(m.config.AllowedSources, c.AllowedSources...)
+	m.config.CertificateAuthorities.Admins = append(m.config.CertificateAuthorities.Admins, c.CertificateAuthorities.Admins...)
+	m.config.CertificateAuthorities.Puppets = append(m.config.CertificateAuthorities.Puppets, c.CertificateAuthorities.Puppets...)
+
+	return nil
+}
@@ -1,27 +1,364 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
 
+// ErrKeyRestricted means the key is known, but its options do not allow the connection.
+var ErrKeyRestricted = errors.New("key is restricted by its options")
+
 type PublicKey struct {
 	ssh.PublicKey
+
+	Name    string     // optional name the key is pinned to
+	Options KeyOptions // authorized_keys options
+	File    string     // keys file the key is read from, if any
 }
 
+// KeyOptions are authorized_keys options meaningful for the proxy.
+type KeyOptions struct {
+	From         []string  // from="": allowed client address patterns, "!" negates
+	ExpiresAt    time.Time // expiry-time="": the key is not accepted after
+	PermitOpen   []string  // permitopen="": puppet:port an admin may connect to, "*" matches any
+	PermitListen []string  // permitlisten="": service ports a puppet may expose, "*" matches any
+
+	NoPortForwarding bool // no-port-forwarding or restrict: neither admin channels nor puppet forwards are allowed
+}
+
+// PublicKeys is a list of keys, an entry may reference an authorized_keys file to read all keys from
+type PublicKeys []PublicKey
+
+// UnmarshalYAML accepts either an authorized key string or a mapping with the key and the name it is pinned to
 func (k *PublicKey) UnmarshalYAML(value *yaml.Node) error {
-	var s string
-	if err := value.Decode(&s); err != nil {
+	var v struct {
+		Key  string `yaml:"key"`
+		Name string `yaml:"name"`
+	}
+
+	if value.Kind == yaml.MappingNode {
+		if err := value.Decode(&v); err != nil {
+			return fmt.Errorf("decoding public key: %w", err)
+		}
+	} else if err := value.Decode(&v.Key); err != nil {
 		return fmt.Errorf("decoding public key: %w", err)
 	}
 
-	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	pk, _, options, _, err := ssh.ParseAuthorizedKey([]byte(v.Key))
+	if err != nil {
+		return fmt.Errorf("parsing public key: %w", err)
+	}
+
+	opts, err := parseKeyOptions(options)
 	if err != nil {
 		return fmt.Errorf("parsing public key: %w", err)
 	}
 
 	k.PublicKey = pk
+	k.Name = v.Name
+	k.Options = opts
 	return nil
 }
+
+// UnmarshalYAML accepts a list of keys, where an entry may be a mapping with keys_file (and the name to pin its keys to).
+// A keys file entry is kept as a reference until the keys are read, see AccessConfig.readKeysFiles.
+func (k *PublicKeys) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		return fmt.Errorf("line %d: expected a list of public keys", value.Line)
+	}
+
+	var keys PublicKeys
+
+	for _, node := range value.Content {
+		var v struct {
+			KeysFile string `yaml:"keys_file"`
+			Name     string `yaml:"name"`
+		}
+		if node.Kind == yaml.MappingNode {
+			if err := node.Decode(&v); err != nil {
+				return fmt.Errorf("decoding public key: %w", err)
+			}
+		}
+
+		if v.KeysFile == "" {
+			var pk PublicKey
+			if err := node.Decode(&pk); err != nil {
+				return err
+			}
+			keys = append(keys, pk)
+			continue
+		}
+
+		keys = append(keys, PublicKey{Name: v.Name, File: v.KeysFile})
+	}
+
+	*k = keys
+	return nil
+}
+
+// resolve makes relative keys file paths relative to the directory of the config file
+func (k PublicKeys) resolve(dir string) {
+	for i := range k {
+		if k[i].File != "" && !filepath.IsAbs(k[i].File) {
+			k[i].File = filepath.Join(dir, k[i].File)
+		}
+	}
+}
+
+// read replaces keys file references with the keys of the files
+func (k PublicKeys) read() (PublicKeys, error) {
+	var keys PublicKeys
+
+	for _, v := range k {
+		if v.PublicKey != nil {
+			keys = append(keys, v)
+			continue
+		}
+
+		fileKeys, err := readKeysFile(v.File)
+		if err != nil {
+			return nil, err
+		}
+		for i := range fileKeys {
+			fileKeys[i].Name = v.Name
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	return keys, nil
+}
+
+// readKeysFile reads all keys of an authorized_keys file
+func readKeysFile(file string) ([]PublicKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading keys file: %w", err)
+	}
+
+	var keys []PublicKey
+
+	for rest := b; len(bytes.TrimSpace(rest)) > 0; {
+		var (
+			pk      ssh.PublicKey
+			options []string
+		)
+		pk, _, options, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			// no more keys, only comments and invalid lines left
+			break
+		}
+
+		opts, err := parseKeyOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("parsing keys file %s: %w", file, err)
+		}
+
+		keys = append(keys, PublicKey{PublicKey: pk, Options: opts, File: file})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys in keys file %s", file)
+	}
+
+	return keys, nil
+}
+
+// parseKeyOptions picks authorized_keys options meaningful for the proxy, others (no-pty, command, etc.) are ignored
+func parseKeyOptions(options []string) (KeyOptions, error) {
+	var opts KeyOptions
+
+	for _, o := range options {
+		name, value, ok := strings.Cut(o, "=")
+		if !ok {
+			// like sshd, port-forwarding after restrict enables forwarding again
+			switch strings.ToLower(name) {
+			case "no-port-forwarding", "restrict":
+				opts.NoPortForwarding = true
+			case "port-forwarding":
+				opts.NoPortForwarding = false
+			}
+			continue
+		}
+
+		switch strings.ToLower(name) {
+		case "from", "expiry-time", "permitopen", "permitlisten":
+		default:
+			// values of ignored options (command, environment, etc.) are not parsed
+			continue
+		}
+
+		value, err := unquoteOption(value)
+		if err != nil {
+			return opts, fmt.Errorf("option %s: %w", name, err)
+		}
+
+		switch strings.ToLower(name) {
+		case "from":
+			opts.From = strings.Split(value, ",")
+
+		case "expiry-time":
+			t, err := parseExpiryTime(value)
+			if err != nil {
+				return opts, fmt.Errorf("option %s: %w", name, err)
+			}
+			opts.ExpiresAt = t
+
+		case "permitopen":
+			if value != "*" && strings.LastIndex(value, ":") < 0 {
+				return opts, fmt.Errorf("option %s: expected host:port, got %q", name, value)
+			}
+			opts.PermitOpen = append(opts.PermitOpen, value)
+
+		case "permitlisten":
+			opts.PermitListen = append(opts.PermitListen, value)
+		}
+	}
+
+	return opts, nil
+}
+
+// unquoteOption strips the quotes of an option value, like sshd only \" is unescaped
+func unquoteOption(v string) (string, error) {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return "", fmt.Errorf("expected a quoted value")
+	}
+	return strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`), nil
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]][Z] of sshd, local time unless Z is set
+func parseExpiryTime(v string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") || strings.HasSuffix(v, "z") {
+		loc = time.UTC
+		v = v[:len(v)-1]
+	}
+
+	var layout string
+	switch len(v) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid time %q", v)
+	}
+
+	return time.ParseInLocation(layout, v, loc)
+}
+
+// checkOptions checks the connection is allowed by the key options
+func (k PublicKey) checkOptions(remote net.Addr) error {
+	if !k.Options.ExpiresAt.IsZero() && time.Now().After(k.Options.ExpiresAt) {
+		return fmt.Errorf("%w: expired at %s", ErrKeyRestricted, k.Options.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if len(k.Options.From) > 0 && !fromAllows(k.Options.From, remote) {
+		return fmt.Errorf("%w: remote address %v is not allowed by from option", ErrKeyRestricted, remote)
+	}
+
+	return nil
+}
+
+// fromAllows matches the remote address against from="" patterns: addresses with wildcards or CIDRs, "!" negates.
+// Host names are not resolved.
+func fromAllows(patterns []string, remote net.Addr) bool {
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	allowed := false
+
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		var matches bool
+		if _, ipNet, err := net.ParseCIDR(p); err == nil {
+			matches = ipNet.Contains(tcpAddr.IP)
+		} else {
+			matches, _ = path.Match(p, tcpAddr.IP.String())
+		}
+
+		if matches && negated {
+			return false
+		}
+		allowed = allowed || matches
+	}
+
+	return allowed
+}
+
+// permitsOpen reports whether the permitopen="" option allows the host and port, any if not set
+func (k PublicKey) permitsOpen(host string, port uint32) bool {
+	if k.Options.NoPortForwarding {
+		return false
+	}
+	if len(k.Options.PermitOpen) == 0 {
+		return true
+	}
+
+	for _, v := range k.Options.PermitOpen {
+		if v == "*" {
+			return true
+		}
+
+		h, p, err := net.SplitHostPort(v)
+		if err != nil {
+			continue
+		}
+		if (h == "*" || h == host) && (p == "*" || p == strconv.FormatUint(uint64(port), 10)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// permitsListen reports whether the permitlisten="" option allows the service port, any if not set
+func (k PublicKey) permitsListen(port uint32) bool {
+	if k.Options.NoPortForwarding {
+		return false
+	}
+	if len(k.Options.PermitListen) == 0 {
+		return true
+	}
+
+	for _, v := range k.Options.PermitListen {
+		// host part is meaningless for the proxy
+		if i := strings.LastIndex(v, ":"); i >= 0 {
+			v = v[i+1:]
+		}
+		if v == "*" || v == strconv.FormatUint(uint64(port), 10) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KeyFingerprintHex returns lowercase hex SHA256 fingerprint of the key.
+// Certificates are fingerprinted by their underlying key, so reissuing a certificate keeps the fingerprint.
+func KeyFingerprintHex(key ssh.PublicKey) string {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		key = cert.Key
+	}
+	sum := sha256.Sum256(key.Marshal())
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseKeyOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		want    KeyOptions
+		wantErr bool
+	}{
+		{"none", nil, KeyOptions{}, false},
+		{"from", []string{`from="10.0.0.0/8,!10.0.0.1"`}, KeyOptions{From: []string{"10.0.0.0/8", "!10.0.0.1"}}, false},
+		{"option names are case insensitive", []string{`FROM="192.0.2.*"`}, KeyOptions{From: []string{"192.0.2.*"}}, false},
+		{"expiry time", []string{`expiry-time="203001021504Z"`}, KeyOptions{ExpiresAt: time.Date(2030, time.January, 2, 15, 4, 0, 0, time.UTC)}, false},
+		{"permitopen is repeatable", []string{`permitopen="shop-1:22"`, `permitopen="*"`}, KeyOptions{PermitOpen: []string{"shop-1:22", "*"}}, false},
+		{"permitlisten", []string{`permitlisten="8000"`}, KeyOptions{PermitListen: []string{"8000"}}, false},
+		{"restrict", []string{"restrict"}, KeyOptions{NoPortForwarding: true}, false},
+		{"port-forwarding after restrict", []string{"restrict", "port-forwarding"}, KeyOptions{}, false},
+		{"no-port-forwarding", []string{"no-pty", "no-port-forwarding"}, KeyOptions{NoPortForwarding: true}, false},
+		{"ignored option values are not parsed", []string{`command="echo \"hi\""`, "environment=FOO"}, KeyOptions{}, false},
+
+		{"unquoted value", []string{"from=10.0.0.1"}, KeyOptions{}, true},
+		{"invalid expiry time", []string{`expiry-time="2030"`}, KeyOptions{}, true},
+		{"permitopen without port", []string{`permitopen="shop-1"`}, KeyOptions{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeyOptions(tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeyOptions() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseKeyOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnquoteOption(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{`"10.0.0.1"`, "10.0.0.1", false},
+		{`""`, "", false},
+		{`"echo \"hi\""`, `echo "hi"`, false},
+		{`"a\\b"`, `a\\b`, false},
+		{`10.0.0.1`, "", true},
+		{`"10.0.0.1`, "", true},
+		{`"`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := unquoteOption(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unquoteOption(%s) error = %v, want error %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("unquoteOption(%s) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromAllows(t *testing.T) {
+	tcp := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 4242}
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		remote   net.Addr
+		want     bool
+	}{
+		{"address", []string{"192.0.2.7"}, tcp("192.0.2.7"), true},
+		{"other address", []string{"192.0.2.7"}, tcp("192.0.2.8"), false},
+		{"cidr", []string{"10.0.0.0/8"}, tcp("10.1.2.3"), true},
+		{"wildcard", []string{"192.0.2.*"}, tcp("192.0.2.200"), true},
+		{"single character wildcard", []string{"192.0.2.?"}, tcp("192.0.2.20"), false},
+		{"any of the patterns", []string{"10.0.0.0/8", "192.0.2.7"}, tcp("192.0.2.7"), true},
+		{"negation wins", []string{"10.0.0.0/8", "!10.0.0.1"}, tcp("10.0.0.1"), false},
+		{"negation wins regardless of order", []string{"!10.0.0.1", "10.0.0.0/8"}, tcp("10.0.0.1"), false},
+		{"negation alone allows nothing", []string{"!10.0.0.1"}, tcp("10.0.0.2"), false},
+		{"ipv6 cidr", []string{"2001:db8::/32"}, tcp("2001:db8::1"), true},
+		{"ipv4-mapped ipv6", []string{"192.0.2.0/24"}, tcp("::ffff:192.0.2.7"), true},
+		{"host names are not resolved", []string{"localhost"}, tcp("127.0.0.1"), false},
+		{"not a tcp address", []string{"*"}, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fromAllows(tt.patterns, tt.remote); got != tt.want {
+				t.Errorf("fromAllows(%v, %v) = %v, want %v", tt.patterns, tt.remote, got, tt.want)
+			}
+		})
+	}
+}
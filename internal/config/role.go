@@ -0,0 +1,26 @@
+package config
+
+import (
+	"regexp"
+	"slices"
+)
+
+type Role struct {
+	Admins []string      `yaml:"admins"` // admin names
+	Rules  []*AccessRule `yaml:"rules"`
+}
+
+type AccessRule struct {
+	Puppets  string   `yaml:"puppets"`  // regexp to match puppet name
+	Services []uint32 `yaml:"services"` // allowed service ports, any if empty
+
+	re *regexp.Regexp
+}
+
+// Allows reports whether the rule permits access to the puppet service.
+func (r *AccessRule) Allows(puppet string, servicePort uint32) bool {
+	if !r.re.MatchString(puppet) {
+		return false
+	}
+	return len(r.Services) == 0 || slices.Contains(r.Services, servicePort)
+}
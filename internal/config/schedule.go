@@ -0,0 +1,199 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	minutesPerDay = 24 * 60
+
+	// scheduleLookahead bounds the search for the end of adjacent windows, a schedule open all week never ends
+	scheduleLookahead = 8 * 24 * time.Hour
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is a set of weekly access windows.
+type Schedule struct {
+	TimeZone      string    `yaml:"timezone"`       // IANA time zone, local time if empty
+	Windows       []*Window `yaml:"windows"`        // access is allowed within any of the windows
+	CloseChannels bool      `yaml:"close_channels"` // close active channels when the window ends
+
+	loc *time.Location
+}
+
+// Window is a weekday time range. A range ending before it starts crosses midnight, e.g. 20:00-07:00.
+type Window struct {
+	Days []string `yaml:"days"` // mon, tue, ... of the window start, any if empty
+	From string   `yaml:"from"` // HH:MM, start of the day if empty
+	To   string   `yaml:"to"`   // HH:MM, end of the day if empty
+
+	days     [7]bool
+	from, to int // minutes of the day
+}
+
+func (s *Schedule) compile() error {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return fmt.Errorf("loading time zone %q: %w", s.TimeZone, err)
+	}
+	s.loc = loc
+
+	if len(s.Windows) == 0 {
+		return fmt.Errorf("no windows")
+	}
+
+	for _, w := range s.Windows {
+		if err := w.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Window) compile() error {
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, v := range w.Days {
+		d, ok := weekdays[strings.ToLower(v)]
+		if !ok {
+			return fmt.Errorf("unknown weekday %q", v)
+		}
+		w.days[d] = true
+	}
+
+	var err error
+	if w.from, err = parseDayMinute(w.From, 0); err != nil {
+		return err
+	}
+	if w.to, err = parseDayMinute(w.To, minutesPerDay); err != nil {
+		return err
+	}
+	if w.from == w.to {
+		return fmt.Errorf("window %s-%s is empty", w.From, w.To)
+	}
+	return nil
+}
+
+func parseDayMinute(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("parsing time %q: expected HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Open reports whether the time is within a window.
+func (s *Schedule) Open(t time.Time) bool {
+	_, ok := s.windowEnd(t)
+	return ok
+}
+
+// End returns when the window the time is within ends, adjacent windows are joined.
+// The zero time is returned if the schedule is open for the lookahead, as well as if it is closed.
+func (s *Schedule) End(t time.Time) time.Time {
+	end, ok := s.windowEnd(t)
+	if !ok {
+		return time.Time{}
+	}
+
+	for end.Sub(t) < scheduleLookahead {
+		next, ok := s.windowEnd(end)
+		if !ok {
+			return end
+		}
+		end = next
+	}
+	return time.Time{}
+}
+
+// windowEnd returns the latest end of windows the time is within
+func (s *Schedule) windowEnd(t time.Time) (time.Time, bool) {
+	t = t.In(s.loc)
+
+	var (
+		end time.Time
+		ok  bool
+	)
+
+	// a window may have started today, or yesterday if crossing midnight
+	for _, daysAgo := range []int{0, 1} {
+		y, m, d := t.Date()
+		day := time.Date(y, m, d-daysAgo, 0, 0, 0, 0, s.loc)
+
+		for _, w := range s.Windows {
+			if !w.days[day.Weekday()] {
+				continue
+			}
+
+			start := dayMinute(day, w.from)
+			stop := dayMinute(day, w.to)
+			if w.to <= w.from {
+				stop = dayMinute(day.AddDate(0, 0, 1), w.to)
+			}
+
+			if !t.Before(start) && t.Before(stop) && stop.After(end) {
+				end, ok = stop, true
+			}
+		}
+	}
+
+	return end, ok
+}
+
+// dayMinute returns the time of the minute of the day, DST transitions are resolved by time.Date
+func dayMinute(day time.Time, minute int) time.Time {
+	y, m, d := day.Date()
+	return time.Date(y, m, d, 0, minute, 0, 0, day.Location())
+}
+
+// ChannelWindow reports whether schedules of the admin and the puppet allow opening a channel at the time,
+// and when the channel must be closed, zero if never. Every puppet entry matching the name must allow it.
+func (c *AccessConfig) ChannelWindow(admin, puppet string, now time.Time) (bool, time.Time) {
+	var schedules []*Schedule
+
+	if a := c.Admins[admin]; a.schedule() != "" {
+		schedules = append(schedules, c.Schedules[a.Schedule])
+	}
+	for _, pu := range c.Puppets {
+		if pu.Schedule != "" && pu.re.MatchString(puppet) {
+			schedules = append(schedules, c.Schedules[pu.Schedule])
+		}
+	}
+
+	var closeAt time.Time
+
+	for _, s := range schedules {
+		if !s.Open(now) {
+			return false, time.Time{}
+		}
+		if !s.CloseChannels {
+			continue
+		}
+		if end := s.End(now); !end.IsZero() && (closeAt.IsZero() || end.Before(closeAt)) {
+			closeAt = end
+		}
+	}
+
+	return true, closeAt
+}
+
+// ChannelWindow reports whether schedules allow opening a channel now according to the current config.
+func (h *AccessConfigHolder) ChannelWindow(admin, puppet string, now time.Time) (bool, time.Time) {
+	return h.Load().ChannelWindow(admin, puppet, now)
+}
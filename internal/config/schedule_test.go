@@ -0,0 +1,92 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindowEnd(t *testing.T) {
+	// 2024-09-02 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.September, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	officeHours := []*Window{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "09:00", To: "17:00"}}
+	fridayNight := []*Window{{Days: []string{"fri"}, From: "22:00", To: "06:00"}}
+	adjacent := []*Window{
+		{Days: []string{"mon"}, From: "20:00"},
+		{Days: []string{"tue"}, To: "08:00"},
+	}
+	always := []*Window{{}}
+
+	tests := []struct {
+		name     string
+		windows  []*Window
+		t        time.Time
+		wantOpen bool
+		wantEnd  time.Time
+	}{
+		{"within window", officeHours, at(2, 10, 0), true, at(2, 17, 0)},
+		{"window start", officeHours, at(2, 9, 0), true, at(2, 17, 0)},
+		{"before window", officeHours, at(2, 8, 59), false, time.Time{}},
+		{"window end is excluded", officeHours, at(2, 17, 0), false, time.Time{}},
+		{"day not in window", officeHours, at(7, 10, 0), false, time.Time{}},
+
+		{"before midnight", fridayNight, at(6, 23, 0), true, at(7, 6, 0)},
+		{"after midnight", fridayNight, at(7, 5, 59), true, at(7, 6, 0)},
+		{"midnight wrap end is excluded", fridayNight, at(7, 6, 0), false, time.Time{}},
+		{"only the start day counts", fridayNight, at(7, 23, 0), false, time.Time{}},
+		{"wrap into the start day", fridayNight, at(6, 5, 0), false, time.Time{}},
+
+		{"adjacent windows are joined", adjacent, at(2, 21, 0), true, at(3, 8, 0)},
+		{"second adjacent window", adjacent, at(3, 1, 0), true, at(3, 8, 0)},
+
+		{"always open never ends", always, at(2, 12, 0), true, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Schedule{TimeZone: "UTC", Windows: tt.windows}
+			if err := s.compile(); err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+
+			if got := s.Open(tt.t); got != tt.wantOpen {
+				t.Errorf("Open(%v) = %v, want %v", tt.t, got, tt.wantOpen)
+			}
+			if got := s.End(tt.t); !got.Equal(tt.wantEnd) {
+				t.Errorf("End(%v) = %v, want %v", tt.t, got, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestWindowCompile(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   Window
+		wantErr  bool
+		wantFrom int
+		wantTo   int
+	}{
+		{"whole day", Window{}, false, 0, minutesPerDay},
+		{"range", Window{From: "09:30", To: "17:00"}, false, 9*60 + 30, 17 * 60},
+		{"midnight wrap", Window{From: "20:00", To: "07:00"}, false, 20 * 60, 7 * 60},
+		{"empty range", Window{From: "10:00", To: "10:00"}, true, 0, 0},
+		{"invalid time", Window{From: "25:00"}, true, 0, 0},
+		{"unknown weekday", Window{Days: []string{"someday"}}, true, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tt.window
+			err := w.compile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (w.from != tt.wantFrom || w.to != tt.wantTo) {
+				t.Errorf("compile() = %d-%d, want %d-%d", w.from, w.to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
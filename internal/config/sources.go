@@ -0,0 +1,78 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ErrSourceNotAllowed means the client address is not in the allowed sources.
+var ErrSourceNotAllowed = errors.New("remote address is not in allowed sources")
+
+// parseSources parses addresses and CIDRs of allowed_sources, an address is a single host prefix
+func parseSources(v []string) ([]netip.Prefix, error) {
+	var sources []netip.Prefix
+
+	for _, s := range v {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			sources = append(sources, p.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing source %q: expected an address or CIDR", s)
+		}
+		sources = append(sources, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return sources, nil
+}
+
+// checkSources checks the remote address against the sources, any address is allowed if there are none
+func checkSources(sources []netip.Prefix, remote net.Addr) error {
+	if len(sources) == 0 {
+		return nil
+	}
+
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("%w: %v is not a TCP address", ErrSourceNotAllowed, remote)
+	}
+
+	addr, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrSourceNotAllowed, remote)
+	}
+	addr = addr.Unmap()
+
+	for _, p := range sources {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %v", ErrSourceNotAllowed, remote)
+}
+
+// CheckSource checks the remote address against the global allowed sources.
+func (c *AccessConfig) CheckSource(remote net.Addr) error {
+	return checkSources(c.sources, remote)
+}
+
+// checkAdminSource checks the remote address against the admin allowed sources, or the global ones if not set
+func (c *AccessConfig) checkAdminSource(name string, remote net.Addr) error {
+	if a := c.Admins[name]; a != nil && len(a.sources) > 0 {
+		return checkSources(a.sources, remote)
+	}
+	return c.CheckSource(remote)
+}
+
+// checkSource checks the remote address against the puppet entry allowed sources, or the global ones if not set
+func (pu *Puppet) checkSource(c *AccessConfig, remote net.Addr) error {
+	if len(pu.sources) > 0 {
+		return checkSources(pu.sources, remote)
+	}
+	return c.CheckSource(remote)
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"slices"
+	"time"
+)
+
+// WatchAccessConfig polls the content of access config files every interval and calls onChange once a change settles.
+// Files are read through symlinks, so atomic renames and symlink swaps (e.g. Kubernetes ConfigMap mounts) are detected.
+// A change must stay the same for another interval before onChange is called, debouncing partial writes.
+func WatchAccessConfig(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	last, _ := accessConfigHash(path)
+	var pending []byte
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		h, err := accessConfigHash(path)
+		if err != nil {
+			// a file may be missing in the middle of a swap
+			continue
+		}
+
+		switch {
+		case bytes.Equal(h, last):
+			pending = nil
+
+		case !bytes.Equal(h, pending):
+			pending = h
+
+		default:
+			last, pending = h, nil
+			onChange()
+		}
+	}
+}
+
+// accessConfigHash hashes names and raw content of the access config files and keys files they refer to.
+// Files are not validated, a broken one changes the hash too, so the reload reports the error.
+func accessConfigHash(path string) ([]byte, error) {
+	files, err := AccessConfigFiles(path)
+	if err != nil {
+		if isDir(path) {
+			return nil, err
+		}
+		// includes of a broken top file are unknown until it is fixed
+		files = []string{path}
+	}
+
+	for _, file := range slices.Clone(files) {
+		if c, err := decodeFragment(file); err == nil {
+			files = append(files, c.KeysFiles()...)
+		}
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte(file))
+		h.Write(b)
+	}
+	return h.Sum(nil), nil
+}
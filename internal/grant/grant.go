@@ -0,0 +1,255 @@
+package grant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gosshpuppet/internal/audit"
+	"gosshpuppet/internal/config"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Grant is a temporary permission of an admin to reach puppet services, on top of the access config.
+type Grant struct {
+	ID          string    `json:"id"`
+	Admin       string    `json:"admin"`
+	Puppets     string    `json:"puppets"` // regexp to match puppet name
+	ServicePort uint32    `json:"service_port"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	GrantedBy   string    `json:"granted_by"`
+	GrantedAt   time.Time `json:"granted_at"`
+
+	re *regexp.Regexp
+}
+
+func (g *Grant) compile() error {
+	re, err := regexp.Compile(g.Puppets)
+	if err != nil {
+		return fmt.Errorf("compiling puppets regexp %q: %w", g.Puppets, err)
+	}
+	g.re = re
+	return nil
+}
+
+// Allows reports whether the grant is active and permits the admin to reach the puppet service.
+func (g *Grant) Allows(admin, puppet string, servicePort uint32) bool {
+	return time.Now().Before(g.ExpiresAt) && g.Admin == admin && g.ServicePort == servicePort && g.re.MatchString(puppet)
+}
+
+// Store keeps grants, persisting them to a state file if its path is set.
+// Expired grants are not effective and dropped on the next change.
+type Store struct {
+	path        string
+	maxDuration time.Duration
+	auditLog    *audit.Log
+
+	m      sync.Mutex
+	grants []*Grant
+}
+
+// NewStore creates a store, loading grants of the state file if it exists.
+// Grants longer than maxDuration are refused, any if zero.
+func NewStore(path string, maxDuration time.Duration, auditLog *audit.Log) (*Store, error) {
+	s := &Store{
+		path:        path,
+		maxDuration: maxDuration,
+		auditLog:    auditLog,
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading grants file: %w", err)
+	}
+
+	var state struct {
+		Grants []*Grant `json:"grants"`
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("decoding grants file: %w", err)
+	}
+
+	for _, g := range state.Grants {
+		if err := g.compile(); err != nil {
+			return nil, fmt.Errorf("grant %s: %w", g.ID, err)
+		}
+		if time.Now().Before(g.ExpiresAt) {
+			s.grants = append(s.grants, g)
+		}
+	}
+
+	return s, nil
+}
+
+// Add adds a grant, assigning its ID and grant time, and saves the state.
+func (s *Store) Add(g Grant) (*Grant, error) {
+	if err := g.compile(); err != nil {
+		return nil, err
+	}
+
+	g.ID = strings.SplitN(uuid.NewString(), "-", 2)[0]
+	g.GrantedAt = time.Now()
+
+	if d := g.ExpiresAt.Sub(g.GrantedAt); d <= 0 {
+		return nil, errors.New("duration must be positive")
+	} else if s.maxDuration > 0 && d > s.maxDuration {
+		return nil, fmt.Errorf("duration exceeds the maximum of %v", s.maxDuration)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	grants := append(s.active(), &g)
+	if err := s.save(grants); err != nil {
+		return nil, err
+	}
+	s.grants = grants
+
+	s.auditLog.Record(audit.Event{
+		Event:       audit.EventGrant,
+		User:        g.GrantedBy,
+		Grant:       g.ID,
+		Grantee:     g.Admin,
+		Puppet:      g.Puppets,
+		ServicePort: g.ServicePort,
+		Duration:    g.ExpiresAt.Sub(g.GrantedAt).Seconds(),
+	})
+
+	return &g, nil
+}
+
+// Revoke removes an active grant by ID and saves the state, by is the admin name for the audit log.
+func (s *Store) Revoke(id, by string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	grants := s.active()
+	i := slices.IndexFunc(grants, func(g *Grant) bool {
+		return g.ID == id
+	})
+	if i < 0 {
+		return false, nil
+	}
+	g := grants[i]
+
+	grants = slices.Delete(grants, i, i+1)
+	if err := s.save(grants); err != nil {
+		return false, err
+	}
+	s.grants = grants
+
+	s.auditLog.Record(audit.Event{
+		Event:       audit.EventRevoke,
+		User:        by,
+		Grant:       g.ID,
+		Grantee:     g.Admin,
+		Puppet:      g.Puppets,
+		ServicePort: g.ServicePort,
+	})
+
+	return true, nil
+}
+
+// Grants returns active grants ordered by expiry.
+func (s *Store) Grants() []Grant {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var ret []Grant
+	for _, g := range s.active() {
+		ret = append(ret, *g)
+	}
+
+	slices.SortFunc(ret, func(a, b Grant) int {
+		return a.ExpiresAt.Compare(b.ExpiresAt)
+	})
+	return ret
+}
+
+// Allows reports whether an active grant permits the admin to reach the puppet service.
+func (s *Store) Allows(admin, puppet string, servicePort uint32) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, g := range s.grants {
+		if g.Allows(admin, puppet, servicePort) {
+			return true
+		}
+	}
+	return false
+}
+
+// active returns a copy of grants not expired yet, must be called locked
+func (s *Store) active() []*Grant {
+	now := time.Now()
+
+	grants := make([]*Grant, 0, len(s.grants))
+	for _, g := range s.grants {
+		if now.Before(g.ExpiresAt) {
+			grants = append(grants, g)
+		}
+	}
+	return grants
+}
+
+// save writes the grants to the state file atomically, must be called locked
+func (s *Store) save(grants []*Grant) error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(struct {
+		Grants []*Grant `json:"grants"`
+	}{grants}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding grants: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("saving grants: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("saving grants: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("saving grants: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return fmt.Errorf("saving grants: %w", err)
+	}
+	return nil
+}
+
+// AccessChecker allows what the access config allows, or an active grant.
+type AccessChecker struct {
+	Config *config.AccessConfigHolder
+	Grants *Store
+}
+
+func (c AccessChecker) CanAccess(admin, puppet string, servicePort uint32) bool {
+	return c.Config.CanAccess(admin, puppet, servicePort) || c.Grants.Allows(admin, puppet, servicePort)
+}
+
+// ChannelWindow applies schedules of the access config, grants do not lift them.
+func (c AccessChecker) ChannelWindow(admin, puppet string, now time.Time) (bool, time.Time) {
+	return c.Config.ChannelWindow(admin, puppet, now)
+}
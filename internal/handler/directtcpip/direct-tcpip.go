@@ -5,9 +5,15 @@ package directtcpip
 
 import (
 	"fmt"
+	"gosshpuppet/internal/audit"
 	"gosshpuppet/internal/client"
+	"gosshpuppet/internal/metrics"
+	"gosshpuppet/internal/puppet"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
@@ -15,17 +21,37 @@ import (
 
 // DirectTcpIPHandler is a handler for direct-tcpip channel requests.
 type DirectTcpIPHandler struct {
-	puppetFinder PuppetFinder
+	puppetFinder  PuppetFinder
+	accessChecker AccessChecker
+	tracker       ChannelTracker
+	auditLog      *audit.Log
 }
 
-// PuppetFinder is an interface for finding an actual local puppet address.
+// PuppetFinder is an interface for finding actual local puppet addresses and counting channels opened to them.
 type PuppetFinder interface {
-	PuppetAddress(name string, servicePort uint32) (addr string, network string, ok bool)
+	PuppetTargets(name string, servicePort uint32) (targets []puppet.PuppetTarget, failover bool)
+	OnChannelBegin(name string, servicePort uint32, sessionID string)
+	OnChannelEnd(name string, servicePort uint32, sessionID string)
 }
 
-func NewDirectTcpip(pf PuppetFinder) *DirectTcpIPHandler {
+// AccessChecker is an interface for checking whether an admin may reach a puppet service and when.
+type AccessChecker interface {
+	CanAccess(admin, puppet string, servicePort uint32) bool
+	ChannelWindow(admin, puppet string, now time.Time) (open bool, closeAt time.Time)
+}
+
+// ChannelTracker is an interface for tracking channels opened by a connection.
+type ChannelTracker interface {
+	AddChannel(sessionID string, ch *client.Channel, close func())
+	RemoveChannel(sessionID string, ch *client.Channel)
+}
+
+func NewDirectTcpip(pf PuppetFinder, ac AccessChecker, ct ChannelTracker, auditLog *audit.Log) *DirectTcpIPHandler {
 	return &DirectTcpIPHandler{
-		puppetFinder: pf,
+		puppetFinder:  pf,
+		accessChecker: ac,
+		tracker:       ct,
+		auditLog:      auditLog,
 	}
 }
 
@@ -41,25 +67,53 @@ func (h *DirectTcpIPHandler) Handle(srv *ssh.Server, conn *gossh.ServerConn, req
 	}
 
 	if srv.LocalPortForwardingCallback == nil || !srv.LocalPortForwardingCallback(ctx, reqData.DestAddr, reqData.DestPort) {
-		req.Reject(gossh.Prohibited, fmt.Sprintf("Port %v forwarding is disallowed", reqData.DestPort))
+		h.reject(req, cli, reqData, gossh.Prohibited, fmt.Sprintf("Port %v forwarding is disallowed", reqData.DestPort))
+		return
+	}
+
+	if !h.accessChecker.CanAccess(cli.Name(), reqData.DestAddr, reqData.DestPort) {
+		logger.Debug(fmt.Sprintf("Access to puppet %s:%d is not allowed", reqData.DestAddr, reqData.DestPort))
+		h.reject(req, cli, reqData, gossh.Prohibited, fmt.Sprintf("Access to %s:%d is disallowed", reqData.DestAddr, reqData.DestPort))
+		return
+	}
+
+	open, closeAt := h.accessChecker.ChannelWindow(cli.Name(), reqData.DestAddr, time.Now())
+	if !open {
+		logger.Debug(fmt.Sprintf("Access to puppet %s:%d is out of schedule", reqData.DestAddr, reqData.DestPort))
+		h.reject(req, cli, reqData, gossh.Prohibited, fmt.Sprintf("Access to %s:%d is disallowed at this time", reqData.DestAddr, reqData.DestPort))
 		return
 	}
 
 	// find puppet
-	target, targetNetwork, ok := h.puppetFinder.PuppetAddress(reqData.DestAddr, reqData.DestPort)
-	if !ok {
+	targets, failover := h.puppetFinder.PuppetTargets(reqData.DestAddr, reqData.DestPort)
+	if len(targets) == 0 {
 		logger.Debug(fmt.Sprintf("Puppet not found for %s:%d", reqData.DestAddr, reqData.DestPort))
-		req.Reject(gossh.ConnectionFailed, "Puppet not found or requested port is unavailable")
+		h.reject(req, cli, reqData, gossh.ConnectionFailed, "Puppet not found or requested port is unavailable")
 		return
 	}
+	if !failover {
+		targets = targets[:1]
+	}
 
-	logger.Debug(fmt.Sprintf("Forwarding to puppet %s:%d => %s", reqData.DestAddr, reqData.DestPort, target))
-
-	var dialer net.Dialer
-	puppetConn, err := dialer.DialContext(ctx, targetNetwork, target)
+	var (
+		target     puppet.PuppetTarget
+		puppetConn net.Conn
+		err        error
+	)
+	for _, target = range targets {
+		logger.Debug(fmt.Sprintf("Forwarding to puppet %s:%d => %s", reqData.DestAddr, reqData.DestPort, target.Address))
+
+		var dialer net.Dialer
+		began := time.Now()
+		puppetConn, err = dialer.DialContext(ctx, target.AddressNetwork, target.Address)
+		metrics.PuppetDialDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(began).Seconds())
+		if err == nil {
+			break
+		}
+		logger.Error(fmt.Sprintf("Failed to dial puppet %v", target.Address), "err", err)
+	}
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to dial puppet %v", target), "err", err)
-		req.Reject(gossh.ConnectionFailed, "Dialing puppet port: "+err.Error())
+		h.reject(req, cli, reqData, gossh.ConnectionFailed, "Dialing puppet port: "+err.Error())
 		return
 	}
 
@@ -72,19 +126,118 @@ func (h *DirectTcpIPHandler) Handle(srv *ssh.Server, conn *gossh.ServerConn, req
 
 	go gossh.DiscardRequests(reqs)
 
-	go func() {
-		defer logger.Debug("Direct-tcpip channel closed")
+	h.puppetFinder.OnChannelBegin(reqData.DestAddr, reqData.DestPort, target.SessionID)
+
+	// closing by the proxy, the copying goroutines finish on closing
+	var closeReason atomic.Value
+	closeChannel := func(reason string) {
+		closeReason.CompareAndSwap(nil, reason)
+		ch.Close()
+		puppetConn.Close()
+	}
+
+	tracked := &client.Channel{
+		Puppet:        reqData.DestAddr,
+		ServicePort:   reqData.DestPort,
+		PuppetSession: target.SessionID,
+		OpenedAt:      time.Now(),
+	}
+	h.tracker.AddChannel(cli.SessionID(), tracked, func() {
+		closeChannel("access revoked")
+	})
+
+	servicePort := metrics.Port(reqData.DestPort)
+	metrics.DirectChannels.WithLabelValues(reqData.DestAddr, servicePort, "opened").Inc()
+	metrics.DirectChannelsActive.WithLabelValues(reqData.DestAddr, servicePort).Inc()
+
+	event := audit.Event{
+		Event:         audit.EventChannelOpen,
+		User:          cli.Name(),
+		Kind:          cli.Kind().String(),
+		Remote:        cli.Remote(),
+		Session:       cli.SessionID(),
+		Fingerprint:   cli.KeyFingerprint(),
+		Puppet:        reqData.DestAddr,
+		ServicePort:   reqData.DestPort,
+		PuppetSession: target.SessionID,
+	}
+	h.auditLog.Record(event)
+
+	began := time.Now()
 
+	var (
+		wg                   sync.WaitGroup
+		toPuppet, fromPuppet int64
+	)
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
 		defer ch.Close()
 		defer puppetConn.Close()
-		io.Copy(ch, puppetConn)
+		fromPuppet, _ = io.Copy(ch, puppetConn)
+		metrics.BytesCopied.WithLabelValues(metrics.DirectionFromPuppet).Add(float64(fromPuppet))
 	}()
 
 	go func() {
+		defer wg.Done()
 		defer ch.Close()
 		defer puppetConn.Close()
-		io.Copy(puppetConn, ch)
+		toPuppet, _ = io.Copy(puppetConn, ch)
+		metrics.BytesCopied.WithLabelValues(metrics.DirectionToPuppet).Add(float64(toPuppet))
 	}()
+
+	// access window ends
+	var windowTimer *time.Timer
+	if !closeAt.IsZero() {
+		windowTimer = time.AfterFunc(time.Until(closeAt), func() {
+			logger.Info(fmt.Sprintf("Closing channel to puppet %s:%d: access window ended", reqData.DestAddr, reqData.DestPort))
+			closeChannel("access window ended")
+		})
+	}
+
+	go func() {
+		wg.Wait()
+
+		if windowTimer != nil {
+			windowTimer.Stop()
+		}
+
+		logger.Debug("Direct-tcpip channel closed")
+		h.puppetFinder.OnChannelEnd(reqData.DestAddr, reqData.DestPort, target.SessionID)
+		h.tracker.RemoveChannel(cli.SessionID(), tracked)
+		metrics.DirectChannelsActive.WithLabelValues(reqData.DestAddr, servicePort).Dec()
+
+		event.Event = audit.EventChannelClose
+		event.Time = time.Time{}
+		event.Duration = time.Since(began).Seconds()
+		event.BytesToPuppet = toPuppet
+		event.BytesFromPuppet = fromPuppet
+		if reason, ok := closeReason.Load().(string); ok {
+			event.Reason = reason
+		}
+		h.auditLog.Record(event)
+	}()
+}
+
+// reject rejects the channel, counting and auditing the rejection
+func (h *DirectTcpIPHandler) reject(req gossh.NewChannel, cli *client.Client, reqData localForwardChannelData, reason gossh.RejectionReason, message string) {
+	// the destination is chosen by the client, labeling it would grow series without bound
+	metrics.DirectChannels.WithLabelValues(metrics.Unknown, metrics.Unknown, "rejected").Inc()
+
+	h.auditLog.Record(audit.Event{
+		Event:       audit.EventChannelReject,
+		User:        cli.Name(),
+		Kind:        cli.Kind().String(),
+		Remote:      cli.Remote(),
+		Session:     cli.SessionID(),
+		Fingerprint: cli.KeyFingerprint(),
+		Puppet:      reqData.DestAddr,
+		ServicePort: reqData.DestPort,
+		Reason:      message,
+	})
+
+	req.Reject(reason, message)
 }
 
 // direct-tcpip data struct as specified in RFC4254, Section 7.2
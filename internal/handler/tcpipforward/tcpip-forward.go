@@ -6,6 +6,7 @@ package tcpipforward
 import (
 	"fmt"
 	"gosshpuppet/internal/client"
+	"gosshpuppet/internal/metrics"
 	"io"
 	"net"
 	"os"
@@ -41,7 +42,7 @@ type TcpIpForwardHandler struct {
 
 // PortManager is an interface for notifying when a port forwarding starts or ends.
 type PortManager interface {
-	OnForwardBegin(ctx ssh.Context, servicePort uint32, actualAddr, addrNetwork string)
+	OnForwardBegin(ctx ssh.Context, servicePort uint32, actualAddr, addrNetwork string) error
 	OnForwardEnd(ctx ssh.Context, servicePort uint32, actualAddr, addrNetwork string)
 }
 
@@ -159,6 +160,17 @@ func (h *TcpIpForwardHandler) Handle(ctx ssh.Context, srv *ssh.Server, req *goss
 			h.m.Unlock()
 		}
 
+		if err := h.portManager.OnForwardBegin(ctx, reqPayload.BindPort, boundAddress, h.network); err != nil {
+			logger.Debug("Forwarding is rejected by port manager", "err", err)
+
+			h.m.Lock()
+			h.removeListener(ctx.SessionID(), reqPayload.BindPort)
+			h.m.Unlock()
+
+			ln.Close()
+			return false, []byte(err.Error())
+		}
+
 		go func() {
 			logger := logger.WithGroup("canceller")
 			defer logger.Debug("Forwarding listener routine end")
@@ -179,9 +191,11 @@ func (h *TcpIpForwardHandler) Handle(ctx ssh.Context, srv *ssh.Server, req *goss
 			logger := logger.WithGroup("listener")
 			defer logger.Debug("Forwarding listener routine end")
 
-			h.portManager.OnForwardBegin(ctx, reqPayload.BindPort, boundAddress, h.network)
 			defer h.portManager.OnForwardEnd(ctx, reqPayload.BindPort, boundAddress, h.network)
 
+			metrics.ReverseForwardsActive.WithLabelValues(metrics.Port(reqPayload.BindPort)).Inc()
+			defer metrics.ReverseForwardsActive.WithLabelValues(metrics.Port(reqPayload.BindPort)).Dec()
+
 			for {
 				c, err := ln.Accept()
 				if err != nil {
@@ -281,6 +295,32 @@ func (h *TcpIpForwardHandler) Handle(ctx ssh.Context, srv *ssh.Server, req *goss
 	}
 }
 
+// Forwards returns service ports forwarded by the session.
+func (h *TcpIpForwardHandler) Forwards(sessionID string) []uint32 {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	ports := make([]uint32, 0, len(h.forwards[sessionID]))
+	for port := range h.forwards[sessionID] {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// CancelForward tears down the session forward of the service port, as if the client canceled it.
+func (h *TcpIpForwardHandler) CancelForward(sessionID string, servicePort uint32) bool {
+	h.m.Lock()
+	ln := h.removeListener(sessionID, servicePort)
+	h.m.Unlock()
+
+	if ln == nil {
+		return false
+	}
+
+	ln.Close()
+	return true
+}
+
 func (h *TcpIpForwardHandler) removeListener(sessionID string, servicePort uint32) net.Listener {
 	var ret net.Listener
 
@@ -0,0 +1,15 @@
+package keepalive
+
+import (
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// RequestType is answered by OpenSSH and x/crypto peers, if only with a failure
+const RequestType = "keepalive@openssh.com"
+
+// Send sends a keepalive request and waits for the reply.
+// Any reply, even a failure, means the peer is alive, so only a broken connection is an error.
+func Send(conn gossh.Conn) error {
+	_, _, err := conn.SendRequest(RequestType, true, nil)
+	return err
+}
@@ -0,0 +1,22 @@
+package keylookup
+
+import (
+	"context"
+
+	"github.com/gliderlabs/ssh"
+)
+
+const DecisionSSHContextKey = "gosshpuppet-key-lookup-decision"
+
+// SetSSHContext stores the decision a client is authenticated by.
+func SetSSHContext(ctx ssh.Context, d *Decision) {
+	ctx.SetValue(DecisionSSHContextKey, d)
+}
+
+// FromContext returns the decision a client is authenticated by, nil if the client is known from the access config.
+func FromContext(ctx context.Context) *Decision {
+	if v, ok := ctx.Value(DecisionSSHContextKey).(*Decision); ok {
+		return v
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package keylookup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Access values of a decision
+const (
+	AccessAdmin  = "admin"
+	AccessPuppet = "puppet"
+	AccessDeny   = "deny"
+)
+
+// ErrBusy is returned when the concurrent lookups limit is reached.
+var ErrBusy = errors.New("too many concurrent lookups")
+
+// Query is a key to look up.
+type Query struct {
+	User        string
+	KeyType     string
+	Fingerprint string // SHA256 fingerprint
+}
+
+// Decision is a reply of an external key source.
+type Decision struct {
+	Access   string   `json:"access"`   // admin, puppet or deny
+	Puppets  []string `json:"puppets"`  // regexps of puppets an admin may reach or names a puppet may identify as, any if empty
+	Services []uint32 `json:"services"` // service ports an admin may reach or a puppet may expose, any if empty
+
+	res []*regexp.Regexp
+}
+
+func (d *Decision) compile() error {
+	switch d.Access {
+	case AccessAdmin, AccessPuppet, AccessDeny:
+	default:
+		return fmt.Errorf("unknown access %q", d.Access)
+	}
+
+	for _, v := range d.Puppets {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("compiling puppets regexp %q: %w", v, err)
+		}
+		d.res = append(d.res, re)
+	}
+	return nil
+}
+
+// AllowsPuppet reports whether the decision allows the puppet name.
+func (d *Decision) AllowsPuppet(name string) bool {
+	if len(d.res) == 0 {
+		return true
+	}
+	for _, re := range d.res {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsService reports whether the decision allows the service port.
+func (d *Decision) AllowsService(servicePort uint32) bool {
+	return len(d.Services) == 0 || slices.Contains(d.Services, servicePort)
+}
+
+// Source is an external key source.
+type Source interface {
+	Lookup(ctx context.Context, q Query) (*Decision, error)
+}
+
+// Cache caches decisions of a source for the TTL.
+// With failOpen the last known decision is used when the source fails, unless it is older than maxStale (0 for any age);
+// otherwise the failure is returned.
+// Keys are looked up before clients prove them, so the source is asked by at most concurrency lookups at once.
+type Cache struct {
+	source   Source
+	ttl      time.Duration
+	failOpen bool
+	maxStale time.Duration
+	sem      chan struct{} // nil for unlimited
+
+	m       sync.Mutex
+	entries map[Query]cacheEntry
+}
+
+type cacheEntry struct {
+	decision  *Decision
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+func NewCache(source Source, ttl time.Duration, failOpen bool, maxStale time.Duration, concurrency int) *Cache {
+	c := &Cache{
+		source:   source,
+		ttl:      ttl,
+		failOpen: failOpen,
+		maxStale: maxStale,
+		entries:  make(map[Query]cacheEntry),
+	}
+	if concurrency > 0 {
+		c.sem = make(chan struct{}, concurrency)
+	}
+	return c
+}
+
+// Lookup returns a cached decision or asks the source.
+// stale is true if the source failed and the last known decision is returned.
+func (c *Cache) Lookup(ctx context.Context, q Query) (d *Decision, stale bool, err error) {
+	c.m.Lock()
+	e, ok := c.entries[q]
+	c.m.Unlock()
+
+	if ok && time.Now().Before(e.expiresAt) {
+		return e.decision, false, nil
+	}
+
+	d, err = c.lookup(ctx, q)
+	if err == nil {
+		err = d.compile()
+	}
+	if err != nil {
+		// a revoked key must not stay valid for as long as the source keeps failing
+		if ok && c.failOpen && (c.maxStale <= 0 || time.Since(e.fetchedAt) <= c.maxStale) {
+			return e.decision, true, nil
+		}
+		return nil, false, err
+	}
+
+	c.m.Lock()
+	now := time.Now()
+	c.entries[q] = cacheEntry{decision: d, fetchedAt: now, expiresAt: now.Add(c.ttl)}
+
+	// expired denials are of no use even when failing open, unknown keys must not pile up,
+	// nor are decisions past the max stale age
+	for k, v := range c.entries {
+		if !now.After(v.expiresAt) {
+			continue
+		}
+		if v.decision.Access == AccessDeny || !c.failOpen || (c.maxStale > 0 && now.Sub(v.fetchedAt) > c.maxStale) {
+			delete(c.entries, k)
+		}
+	}
+	c.m.Unlock()
+
+	return d, false, nil
+}
+
+// lookup asks the source, failing at once if it is busy with other lookups
+func (c *Cache) lookup(ctx context.Context, q Query) (*Decision, error) {
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		default:
+			return nil, ErrBusy
+		}
+	}
+	return c.source.Lookup(ctx, q)
+}
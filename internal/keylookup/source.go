@@ -0,0 +1,83 @@
+package keylookup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"time"
+)
+
+// Command asks an external command, like OpenSSH AuthorizedKeysCommand.
+// The command is run with user name, key type and fingerprint as arguments after "--", so a user name is never read as an option,
+// and replies a JSON decision to stdout.
+type Command struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (c *Command) Lookup(ctx context.Context, q Query) (*Decision, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, c.Path, "--", q.User, q.KeyType, q.Fingerprint)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running %s: %w: %s", c.Path, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var d Decision
+	if err := json.Unmarshal(stdout.Bytes(), &d); err != nil {
+		return nil, fmt.Errorf("decoding %s reply: %w", c.Path, err)
+	}
+	return &d, nil
+}
+
+// HTTP asks an HTTP endpoint with GET ?user=&type=&fingerprint= and expects a JSON decision with 200 OK.
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *HTTP) Lookup(ctx context.Context, q Query) (*Decision, error) {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url: %w", err)
+	}
+
+	values := u.Query()
+	values.Set("user", q.User)
+	values.Set("type", q.KeyType)
+	values.Set("fingerprint", q.Fingerprint)
+	u.RawQuery = values.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("making request: %w", err)
+	}
+
+	res, err := h.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	var d Decision
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&d); err != nil {
+		return nil, fmt.Errorf("decoding reply: %w", err)
+	}
+	return &d, nil
+}
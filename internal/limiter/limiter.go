@@ -0,0 +1,303 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"gosshpuppet/internal/audit"
+	"gosshpuppet/internal/logging"
+	"gosshpuppet/internal/metrics"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Rejection reasons
+const (
+	ReasonBanned          = "banned"
+	ReasonRate            = "rate"
+	ReasonUnauthenticated = "unauthenticated"
+)
+
+const sweepInterval = time.Minute
+
+// Options of the limiter, a zero value disables the limit.
+type Options struct {
+	MaxFailures   int           // connections per IP failing authentication within FailureWindow before a ban
+	FailureWindow time.Duration // window of counted failures
+	BanDuration   time.Duration // how long a banned IP is rejected
+
+	MaxUnauthenticated int     // concurrent connections not authenticated yet
+	ConnRate           float64 // new connections per second per IP, bursts up to max(1, rate)
+}
+
+// Ban is a banned IP.
+type Ban struct {
+	IP    netip.Addr
+	Until time.Time
+}
+
+// Limiter protects the server from brute force: it bans IPs failing authentication too often,
+// limits the connection rate per IP and the number of connections not authenticated yet.
+type Limiter struct {
+	opts     Options
+	logger   *slog.Logger
+	auditLog *audit.Log
+
+	m         sync.Mutex
+	peers     map[netip.Addr]*peer
+	pending   map[string]*conn // remote address -> connection not authenticated yet
+	lastSweep time.Time
+}
+
+type peer struct {
+	failures    []time.Time
+	bannedUntil time.Time
+
+	tokens   float64
+	lastConn time.Time
+}
+
+func New(baseCtx context.Context, opts Options, auditLog *audit.Log) *Limiter {
+	return &Limiter{
+		opts:      opts,
+		logger:    logging.FromContext(baseCtx).WithGroup("limiter"),
+		auditLog:  auditLog,
+		peers:     make(map[netip.Addr]*peer),
+		pending:   make(map[string]*conn),
+		lastSweep: time.Now(),
+	}
+}
+
+// admit registers a new connection, the reason is empty if it is admitted
+func (l *Limiter) admit(c *conn) string {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	p := l.peer(c.ip)
+
+	if now.Before(p.bannedUntil) {
+		return ReasonBanned
+	}
+
+	if l.opts.ConnRate > 0 {
+		burst := max(1, l.opts.ConnRate)
+		if p.lastConn.IsZero() {
+			p.tokens = burst
+		} else {
+			p.tokens = min(burst, p.tokens+now.Sub(p.lastConn).Seconds()*l.opts.ConnRate)
+		}
+		p.lastConn = now
+
+		if p.tokens < 1 {
+			return ReasonRate
+		}
+		p.tokens--
+	}
+
+	if l.opts.MaxUnauthenticated > 0 && len(l.pending) >= l.opts.MaxUnauthenticated {
+		return ReasonUnauthenticated
+	}
+
+	l.pending[c.key] = c
+	return ""
+}
+
+func (l *Limiter) peer(ip netip.Addr) *peer {
+	p, ok := l.peers[ip]
+	if !ok {
+		p = &peer{}
+		l.peers[ip] = p
+	}
+	return p
+}
+
+// sweep forgets peers with nothing to remember, must be called locked
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, p := range l.peers {
+		p.failures = l.recentFailures(p, now)
+
+		idle := l.opts.ConnRate <= 0 || now.Sub(p.lastConn).Seconds()*l.opts.ConnRate >= max(1, l.opts.ConnRate)
+		if len(p.failures) == 0 && !now.Before(p.bannedUntil) && idle {
+			delete(l.peers, ip)
+		}
+	}
+}
+
+func (l *Limiter) recentFailures(p *peer, now time.Time) []time.Time {
+	i := 0
+	for i < len(p.failures) && now.Sub(p.failures[i]) > l.opts.FailureWindow {
+		i++
+	}
+	return p.failures[i:]
+}
+
+// Failure counts a connection of the remote address that failed to authenticate and bans its IP when there are too many.
+// Connections of a banned IP not authenticated yet are closed.
+func (l *Limiter) Failure(remote net.Addr) {
+	if l == nil || l.opts.MaxFailures <= 0 {
+		return
+	}
+
+	ip, ok := addrIP(remote)
+	if !ok {
+		return
+	}
+
+	l.m.Lock()
+
+	now := time.Now()
+	p := l.peer(ip)
+	if now.Before(p.bannedUntil) {
+		l.m.Unlock()
+		return
+	}
+
+	p.failures = append(l.recentFailures(p, now), now)
+	if len(p.failures) < l.opts.MaxFailures {
+		l.m.Unlock()
+		return
+	}
+
+	failures := len(p.failures)
+	p.failures = nil
+	p.bannedUntil = now.Add(l.opts.BanDuration)
+
+	var conns []*conn
+	for _, c := range l.pending {
+		if c.ip == ip {
+			conns = append(conns, c)
+		}
+	}
+	l.m.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+
+	l.logger.Warn(fmt.Sprintf("IP is banned for %v after %d failed authentications", l.opts.BanDuration, failures), "ip", ip.String())
+	metrics.Bans.Inc()
+	l.auditLog.Record(audit.Event{
+		Event:  audit.EventBan,
+		Remote: ip.String(),
+		Reason: fmt.Sprintf("%d failed authentications", failures),
+	})
+}
+
+// Authenticated releases the connection of the remote address from the unauthenticated limit.
+func (l *Limiter) Authenticated(remote net.Addr) {
+	if l == nil {
+		return
+	}
+
+	l.m.Lock()
+	delete(l.pending, remote.String())
+	l.m.Unlock()
+}
+
+// Banned reports whether the IP of the remote address is banned.
+func (l *Limiter) Banned(remote net.Addr) bool {
+	if l == nil {
+		return false
+	}
+
+	ip, ok := addrIP(remote)
+	if !ok {
+		return false
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	p, ok := l.peers[ip]
+	return ok && time.Now().Before(p.bannedUntil)
+}
+
+// Bans returns active bans ordered by IP.
+func (l *Limiter) Bans() []Ban {
+	if l == nil {
+		return nil
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+
+	var bans []Ban
+	for ip, p := range l.peers {
+		if now.Before(p.bannedUntil) {
+			bans = append(bans, Ban{IP: ip, Until: p.bannedUntil})
+		}
+	}
+
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return a.IP.Compare(b.IP)
+	})
+	return bans
+}
+
+// Unban clears the ban and failed authentications of the IP, or of all IPs if ip is invalid (zero).
+// The number of cleared bans is returned, by is the admin name for the audit log.
+func (l *Limiter) Unban(ip netip.Addr, by string) int {
+	if l == nil {
+		return 0
+	}
+
+	l.m.Lock()
+
+	now := time.Now()
+
+	var cleared []netip.Addr
+	for v, p := range l.peers {
+		if ip.IsValid() && v != ip {
+			continue
+		}
+		if now.Before(p.bannedUntil) {
+			cleared = append(cleared, v)
+		}
+		p.bannedUntil = time.Time{}
+		p.failures = nil
+	}
+	l.m.Unlock()
+
+	for _, v := range cleared {
+		l.logger.Info("IP is unbanned", "ip", v.String(), "by", by)
+		l.auditLog.Record(audit.Event{
+			Event:  audit.EventUnban,
+			User:   by,
+			Remote: v.String(),
+		})
+	}
+
+	return len(cleared)
+}
+
+// release forgets a closed connection
+func (l *Limiter) release(c *conn) {
+	l.m.Lock()
+	if l.pending[c.key] == c {
+		delete(l.pending, c.key)
+	}
+	l.m.Unlock()
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	return ip.Unmap(), ok
+}
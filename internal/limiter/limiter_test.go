@@ -0,0 +1,64 @@
+package limiter
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanExpiry(t *testing.T) {
+	const (
+		banDuration   = 50 * time.Millisecond
+		failureWindow = 50 * time.Millisecond
+	)
+
+	tests := []struct {
+		name          string
+		failures      int           // before waiting
+		wait          time.Duration // after the failures
+		failuresAfter int           // after waiting
+		wantBanned    bool
+	}{
+		{"below the limit", 2, 0, 0, false},
+		{"at the limit", 3, 0, 0, true},
+		{"ban is active before it expires", 3, banDuration / 5, 0, true},
+		{"ban expires", 3, 2 * banDuration, 0, false},
+		{"failures are counted again after the ban", 3, 2 * banDuration, 3, true},
+		{"failures within the window add up", 2, failureWindow / 5, 1, true},
+		{"failures out of the window are forgotten", 2, 2 * failureWindow, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			l := New(context.Background(), Options{
+				MaxFailures:   3,
+				FailureWindow: failureWindow,
+				BanDuration:   banDuration,
+			}, nil)
+			remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 4242}
+
+			for range tt.failures {
+				l.Failure(remote)
+			}
+			time.Sleep(tt.wait)
+			for range tt.failuresAfter {
+				l.Failure(remote)
+			}
+
+			if got := l.Banned(remote); got != tt.wantBanned {
+				t.Errorf("Banned() = %v, want %v", got, tt.wantBanned)
+			}
+			if got := len(l.Bans()) > 0; got != tt.wantBanned {
+				t.Errorf("Bans() = %v, want banned %v", l.Bans(), tt.wantBanned)
+			}
+
+			other := &net.TCPAddr{IP: net.ParseIP("192.0.2.8"), Port: 4242}
+			if l.Banned(other) {
+				t.Errorf("Banned() of another IP = true, want false")
+			}
+		})
+	}
+}
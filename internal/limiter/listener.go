@@ -0,0 +1,113 @@
+package limiter
+
+import (
+	"gosshpuppet/internal/metrics"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// Listener wraps the server listener, rejected connections are closed before they reach the handshake.
+// Connections are admitted concurrently, so a slow peer (e.g. of a PROXY protocol header) does not block others.
+func (l *Limiter) Listener(ln net.Listener) net.Listener {
+	ll := &listener{
+		Listener: ln,
+		l:        l,
+		accepted: make(chan accepted),
+		done:     make(chan struct{}),
+	}
+	go ll.serve()
+	return ll
+}
+
+type listener struct {
+	net.Listener
+	l *Limiter
+
+	accepted  chan accepted
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+func (ll *listener) serve() {
+	for {
+		c, err := ll.Listener.Accept()
+		if err != nil {
+			select {
+			case ll.accepted <- accepted{err: err}:
+			case <-ll.done:
+				return
+			}
+
+			// the server retries temporary errors
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		go ll.admit(c)
+	}
+}
+
+func (ll *listener) admit(c net.Conn) {
+	ip, ok := addrIP(c.RemoteAddr())
+	if !ok {
+		// not an IP peer, nothing to limit
+		ip = netip.Addr{}
+	}
+
+	lc := &conn{Conn: c, l: ll.l, ip: ip, key: c.RemoteAddr().String()}
+
+	if reason := ll.l.admit(lc); reason != "" {
+		metrics.ConnectionsRejected.WithLabelValues(reason).Inc()
+		ll.l.logger.Debug("Connection is rejected", "remote", lc.key, "reason", reason)
+		c.Close()
+		return
+	}
+
+	select {
+	case ll.accepted <- accepted{conn: lc}:
+	case <-ll.done:
+		lc.Close()
+	}
+}
+
+func (ll *listener) Accept() (net.Conn, error) {
+	select {
+	case a := <-ll.accepted:
+		return a.conn, a.err
+	case <-ll.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ll *listener) Close() error {
+	ll.closeOnce.Do(func() {
+		close(ll.done)
+	})
+	return ll.Listener.Close()
+}
+
+// conn is an admitted connection, counted as unauthenticated until Limiter.Authenticated or closing
+type conn struct {
+	net.Conn
+	l *Limiter
+
+	ip  netip.Addr
+	key string
+
+	closeOnce sync.Once
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.l.release(c)
+	})
+	return c.Conn.Close()
+}
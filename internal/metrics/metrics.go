@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gosshpuppet"
+
+// Unknown labels client-chosen values, like the puppet and port of a rejected channel
+const Unknown = "unknown"
+
+// Directions of copied bytes
+const (
+	DirectionToPuppet   = "to_puppet"
+	DirectionFromPuppet = "from_puppet"
+)
+
+var (
+	// ClientsConnected is a number of authenticated connections by client kind
+	ClientsConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "clients_connected",
+		Help:      "Authenticated client connections by kind.",
+	}, []string{"kind"})
+
+	// AuthAttempts counts public key authentication attempts by result and reason
+	AuthAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_attempts_total",
+		Help:      "Public key authentication attempts by result and reason.",
+	}, []string{"result", "reason"})
+
+	// ReverseForwardsActive is a number of active puppet reverse forwards by service port
+	ReverseForwardsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reverse_forwards_active",
+		Help:      "Active puppet reverse forwards by service port.",
+	}, []string{"service_port"})
+
+	// DirectChannels counts admin direct-tcpip channels by puppet, service port and result
+	DirectChannels = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "direct_channels_total",
+		Help:      "Admin direct-tcpip channels by puppet, service port and result (opened, rejected), rejected ones are labeled unknown.",
+	}, []string{"puppet", "service_port", "result"})
+
+	// DirectChannelsActive is a number of active admin direct-tcpip channels by puppet and service port
+	DirectChannelsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "direct_channels_active",
+		Help:      "Active admin direct-tcpip channels by puppet and service port.",
+	}, []string{"puppet", "service_port"})
+
+	// BytesCopied counts bytes copied between admins and puppets by direction
+	BytesCopied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_copied_total",
+		Help:      "Bytes copied between admins and puppets by direction (to_puppet, from_puppet).",
+	}, []string{"direction"})
+
+	// ConfigReloads counts access config reloads by trigger and result
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Access config reloads by trigger (signal, watch) and result (success, failure).",
+	}, []string{"trigger", "result"})
+
+	// PuppetDialDuration observes dial latency to puppet listeners by result
+	PuppetDialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "puppet_dial_duration_seconds",
+		Help:      "Dial latency to puppet listeners by result (success, failure).",
+		Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"result"})
+
+	// ConnectionsRejected counts connections rejected by the limiter before the handshake by reason
+	ConnectionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_rejected_total",
+		Help:      "Connections rejected before the handshake by reason (banned, rate, unauthenticated).",
+	}, []string{"reason"})
+
+	// Bans counts peers banned for failed authentication attempts
+	Bans = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bans_total",
+		Help:      "Peers banned for failed authentication attempts.",
+	})
+)
+
+// Port formats a service port label
+func Port(port uint32) string {
+	return strconv.FormatUint(uint64(port), 10)
+}
+
+// Result formats a success/failure label
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Serve exposes metrics over HTTP on /metrics until the context is done
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
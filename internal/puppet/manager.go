@@ -1,28 +1,49 @@
 package puppet
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"gosshpuppet/internal/audit"
 	"gosshpuppet/internal/client"
-	"gosshpuppet/internal/logging"
+	"gosshpuppet/internal/config"
+	"gosshpuppet/internal/keepalive"
+	"net"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
 )
 
-// Manager keeps track of puppet latest sessions identified by name and service port
+// Manager keeps track of puppet sessions identified by name and service port
 type Manager struct {
 	m       sync.Mutex
-	puppets map[namePort]*PuppetSession
+	puppets map[namePort][]*PuppetSession // oldest first
+	rounds  map[namePort]uint64           // round-robin counters
+
+	accessConfig *config.AccessConfigHolder
+	auditLog     *audit.Log
 }
 
+var (
+	// ErrPuppetKeyMismatch means a pinned puppet session is already held by another key.
+	ErrPuppetKeyMismatch = errors.New("puppet is connected with another key")
+	// ErrPuppetDuplicate means the puppet service is already registered and the policy rejects newer sessions.
+	ErrPuppetDuplicate = errors.New("puppet service is already registered")
+	// ErrPuppetNotFound means the puppet service has no session.
+	ErrPuppetNotFound = errors.New("puppet service is not connected")
+)
+
 type namePort struct {
 	Name        string
 	ServicePort uint32
 }
 
 func (np namePort) String() string {
-	return np.Name + ":" + string(np.ServicePort)
+	return np.Name + ":" + strconv.FormatUint(uint64(np.ServicePort), 10)
 }
 
 type PuppetSession struct {
@@ -31,13 +52,31 @@ type PuppetSession struct {
 	Address        string
 	AddressNetwork string
 
-	SessionID string
-	CreatedAt time.Time
+	Remote         string
+	SessionID      string
+	KeyFingerprint string
+	ClientVersion  string
+	ConnectedAt    time.Time // session authentication time
+	CreatedAt      time.Time // forward registration time
+
+	Channels int // active admin channels
+
+	conn gossh.Conn
 }
 
-func NewMapper() *Manager {
+// PuppetTarget is a puppet service session address to dial
+type PuppetTarget struct {
+	Address        string
+	AddressNetwork string
+	SessionID      string
+}
+
+func NewMapper(ac *config.AccessConfigHolder, auditLog *audit.Log) *Manager {
 	return &Manager{
-		puppets: make(map[namePort]*PuppetSession),
+		puppets:      make(map[namePort][]*PuppetSession),
+		rounds:       make(map[namePort]uint64),
+		accessConfig: ac,
+		auditLog:     auditLog,
 	}
 }
 
@@ -48,22 +87,28 @@ func newNamePort(name string, servicePort uint32) namePort {
 	}
 }
 
-func (m *Manager) Puppets() map[string]map[uint32]PuppetSession {
+// Puppets returns sessions of every puppet service, oldest first
+func (m *Manager) Puppets() map[string]map[uint32][]PuppetSession {
 	m.m.Lock()
 	defer m.m.Unlock()
 
-	puppets := make(map[string]map[uint32]PuppetSession)
+	puppets := make(map[string]map[uint32][]PuppetSession)
 
-	for np, ps := range m.puppets {
-		puppets[np.Name] = make(map[uint32]PuppetSession)
-		puppets[np.Name][np.ServicePort] = *ps
+	for np, sessions := range m.puppets {
+		if _, ok := puppets[np.Name]; !ok {
+			puppets[np.Name] = make(map[uint32][]PuppetSession)
+		}
+		for _, ps := range sessions {
+			puppets[np.Name][np.ServicePort] = append(puppets[np.Name][np.ServicePort], *ps)
+		}
 	}
 
 	return puppets
 }
 
-func (m *Manager) OnForwardBegin(ctx ssh.Context, servicePort uint32, actualAddr, addrNetwork string) {
+func (m *Manager) OnForwardBegin(ctx ssh.Context, servicePort uint32, actualAddr, addrNetwork string) error {
 	cli := client.FromSSHContext(ctx)
+	logger := cli.Logger().WithGroup("puppet")
 
 	namePort := newNamePort(cli.Name(), servicePort)
 
@@ -72,20 +117,92 @@ func (m *Manager) OnForwardBegin(ctx ssh.Context, servicePort uint32, actualAddr
 		ServicePort:    servicePort,
 		Address:        actualAddr,
 		AddressNetwork: addrNetwork,
+		Remote:         cli.Remote(),
 		SessionID:      cli.SessionID(),
+		KeyFingerprint: cli.KeyFingerprint(),
+		ClientVersion:  ctx.ClientVersion(),
+		ConnectedAt:    cli.CreatedAt(),
 		CreatedAt:      time.Now(),
 	}
+	if conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn); ok {
+		ps.conn = conn
+	}
+
+	cfg := m.accessConfig.Load()
+	pinned := cfg.PuppetPinned(cli.Name())
+	policy := cfg.PuppetDuplicatePolicy(cli.Name())
 
 	m.m.Lock()
 
-	old := m.puppets[namePort]
-	m.puppets[namePort] = ps
+	existing := m.puppets[namePort]
+
+	if pinned {
+		for _, old := range existing {
+			if old.KeyFingerprint == ps.KeyFingerprint {
+				continue
+			}
+
+			m.m.Unlock()
+
+			logger.Warn(
+				fmt.Sprintf("Impersonation attempt: puppet session %s is held by another key", namePort),
+				"holder_session", old.SessionID,
+				"holder_fingerprint", old.KeyFingerprint,
+				"fingerprint", ps.KeyFingerprint,
+			)
+			m.recordSession(audit.EventPuppetReject, ps, ErrPuppetKeyMismatch.Error())
+			return ErrPuppetKeyMismatch
+		}
+	}
+
+	var replaced []*PuppetSession
+
+	switch policy {
+	case config.DuplicateRejectNew:
+		if len(existing) > 0 {
+			m.m.Unlock()
+
+			logger.Warn(fmt.Sprintf("Rejected duplicate puppet session %s", namePort), "holder_session", existing[0].SessionID, "holder_remote", existing[0].Remote)
+			m.recordSession(audit.EventPuppetReject, ps, ErrPuppetDuplicate.Error())
+			return ErrPuppetDuplicate
+		}
+		m.puppets[namePort] = []*PuppetSession{ps}
+
+	case config.DuplicateKeepBoth:
+		m.puppets[namePort] = append(existing, ps)
+
+	default:
+		replaced = existing
+		m.puppets[namePort] = []*PuppetSession{ps}
+	}
 
 	m.m.Unlock()
 
-	if old != nil {
-		logging.FromContext(ctx).WithGroup("puppet").Debug(fmt.Sprintf("Replaced puppet session %s: %s => %s", namePort, old.SessionID, ps.SessionID))
+	m.recordSession(audit.EventPuppetConnect, ps, "")
+
+	for _, old := range existing {
+		if remoteHost(old.Remote) != remoteHost(ps.Remote) {
+			logger.Warn(
+				fmt.Sprintf("Puppet session %s is claimed from different addresses", namePort),
+				"holder_session", old.SessionID,
+				"holder_remote", old.Remote,
+				"policy", policy,
+			)
+		}
+	}
+
+	for _, old := range replaced {
+		m.recordSession(audit.EventPuppetDisconnect, old, "replaced by "+ps.SessionID)
+
+		if policy == config.DuplicateKickOld && old.conn != nil {
+			logger.Info(fmt.Sprintf("Kicking older puppet session %s: %s", namePort, old.SessionID))
+			old.conn.Close()
+			continue
+		}
+		logger.Debug(fmt.Sprintf("Replaced puppet session %s: %s => %s", namePort, old.SessionID, ps.SessionID))
 	}
+
+	return nil
 }
 
 func (m *Manager) OnForwardEnd(ctx ssh.Context, servicePort uint32, actualAddr, addrNetwork string) {
@@ -95,18 +212,53 @@ func (m *Manager) OnForwardEnd(ctx ssh.Context, servicePort uint32, actualAddr,
 
 	m.m.Lock()
 
-	if ps, ok := m.puppets[namePort]; ok && ps.SessionID == cli.SessionID() {
+	var ended []*PuppetSession
+	sessions := slices.DeleteFunc(m.puppets[namePort], func(ps *PuppetSession) bool {
+		if ps.SessionID == cli.SessionID() {
+			ended = append(ended, ps)
+			return true
+		}
+		return false
+	})
+	if len(sessions) == 0 {
 		delete(m.puppets, namePort)
+		delete(m.rounds, namePort)
+	} else {
+		m.puppets[namePort] = sessions
 	}
 
 	m.m.Unlock()
+
+	for _, ps := range ended {
+		m.recordSession(audit.EventPuppetDisconnect, ps, "")
+	}
 }
 
+func (m *Manager) recordSession(event string, ps *PuppetSession, reason string) {
+	e := audit.Event{
+		Event:       event,
+		User:        ps.Name,
+		Kind:        client.ClientPuppet.String(),
+		Remote:      ps.Remote,
+		Session:     ps.SessionID,
+		Fingerprint: ps.KeyFingerprint,
+		Puppet:      ps.Name,
+		ServicePort: ps.ServicePort,
+		Reason:      reason,
+	}
+	if event == audit.EventPuppetDisconnect {
+		e.Duration = time.Since(ps.CreatedAt).Seconds()
+	}
+	m.auditLog.Record(e)
+}
+
+// PuppetAddress returns the address of the newest puppet service session
 func (m *Manager) PuppetAddress(name string, servicePort uint32) (addr, network string, ok bool) {
 	namePort := newNamePort(name, servicePort)
 
 	m.m.Lock()
-	if ps, ok := m.puppets[namePort]; ok {
+	if sessions := m.puppets[namePort]; len(sessions) > 0 {
+		ps := sessions[len(sessions)-1]
 		addr = ps.Address
 		network = ps.AddressNetwork
 	}
@@ -114,3 +266,111 @@ func (m *Manager) PuppetAddress(name string, servicePort uint32) (addr, network
 
 	return addr, network, addr != ""
 }
+
+// Ping measures the round trip of a keepalive request over the connection of the newest puppet service session.
+func (m *Manager) Ping(ctx context.Context, name string, servicePort uint32) (sessionID string, rtt time.Duration, err error) {
+	namePort := newNamePort(name, servicePort)
+
+	var conn gossh.Conn
+
+	m.m.Lock()
+	if sessions := m.puppets[namePort]; len(sessions) > 0 {
+		ps := sessions[len(sessions)-1]
+		sessionID = ps.SessionID
+		conn = ps.conn
+	}
+	m.m.Unlock()
+
+	if conn == nil {
+		return sessionID, 0, ErrPuppetNotFound
+	}
+
+	began := time.Now()
+	replied := make(chan error, 1)
+	go func() {
+		replied <- keepalive.Send(conn)
+	}()
+
+	select {
+	case err := <-replied:
+		return sessionID, time.Since(began), err
+	case <-ctx.Done():
+		return sessionID, 0, ctx.Err()
+	}
+}
+
+// PuppetTargets returns puppet service sessions in the order of the puppet balance strategy.
+// Only the first target should be dialed unless failover is true.
+func (m *Manager) PuppetTargets(name string, servicePort uint32) (targets []PuppetTarget, failover bool) {
+	namePort := newNamePort(name, servicePort)
+
+	strategy, failover := m.accessConfig.Load().PuppetBalance(name)
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	sessions := slices.Clone(m.puppets[namePort])
+	if len(sessions) == 0 {
+		return nil, false
+	}
+
+	// newest first
+	slices.Reverse(sessions)
+
+	switch strategy {
+	case config.BalanceRoundRobin:
+		n := m.rounds[namePort]
+		m.rounds[namePort] = n + 1
+
+		i := int(n % uint64(len(sessions)))
+		sessions = append(sessions[i:], sessions[:i]...)
+
+	case config.BalanceLeastConnections:
+		slices.SortStableFunc(sessions, func(a, b *PuppetSession) int {
+			return a.Channels - b.Channels
+		})
+	}
+
+	targets = make([]PuppetTarget, 0, len(sessions))
+	for _, ps := range sessions {
+		targets = append(targets, PuppetTarget{
+			Address:        ps.Address,
+			AddressNetwork: ps.AddressNetwork,
+			SessionID:      ps.SessionID,
+		})
+	}
+
+	return targets, failover
+}
+
+// OnChannelBegin counts an admin channel opened to the puppet service session
+func (m *Manager) OnChannelBegin(name string, servicePort uint32, sessionID string) {
+	m.addChannels(name, servicePort, sessionID, 1)
+}
+
+// OnChannelEnd uncounts an admin channel opened to the puppet service session
+func (m *Manager) OnChannelEnd(name string, servicePort uint32, sessionID string) {
+	m.addChannels(name, servicePort, sessionID, -1)
+}
+
+func (m *Manager) addChannels(name string, servicePort uint32, sessionID string, delta int) {
+	namePort := newNamePort(name, servicePort)
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for _, ps := range m.puppets[namePort] {
+		if ps.SessionID == sessionID {
+			ps.Channels += delta
+			return
+		}
+	}
+}
+
+func remoteHost(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
@@ -6,15 +6,22 @@ import (
 	"flag"
 	"fmt"
 	"gosshpuppet/internal"
+	"gosshpuppet/internal/audit"
 	"gosshpuppet/internal/callback"
+	"gosshpuppet/internal/client"
 	"gosshpuppet/internal/command"
 	"gosshpuppet/internal/config"
+	"gosshpuppet/internal/grant"
 	"gosshpuppet/internal/handler/directtcpip"
 	"gosshpuppet/internal/handler/tcpipforward"
+	"gosshpuppet/internal/keylookup"
+	"gosshpuppet/internal/limiter"
 	"gosshpuppet/internal/logging"
+	"gosshpuppet/internal/metrics"
 	"gosshpuppet/internal/puppet"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -22,13 +29,21 @@ import (
 	"time"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/pires/go-proxyproto"
 	gossh "golang.org/x/crypto/ssh"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		agentMain(os.Args[2:])
+		return
+	}
+
 	var (
-		argListenAddr   string
-		argAccessConfig string
+		argListenAddr    string
+		argAccessConfig  string
+		argWatchConfig   bool
+		argWatchInterval time.Duration
 
 		argHostPrivateKeys   StringSliceArg
 		argHostSocketNetwork string
@@ -36,12 +51,41 @@ func main() {
 		argIdleTimeout    time.Duration
 		argOverallTimeout time.Duration
 
+		argProxyProtocol        bool
+		argProxyProtocolFrom    StringSliceArg
+		argProxyProtocolTimeout time.Duration
+
+		argMaxAuthFailures    int
+		argAuthFailureWindow  time.Duration
+		argBanDuration        time.Duration
+		argMaxUnauthenticated int
+		argMaxConnRate        float64
+
+		argKeepaliveInterval time.Duration
+		argKeepaliveCountMax int
+
+		argMetricsListenAddr string
+		argAuditLog          string
+
+		argGrantsFile       string
+		argGrantMaxDuration time.Duration
+
+		argKeyLookupCommand     string
+		argKeyLookupURL         string
+		argKeyLookupTTL         time.Duration
+		argKeyLookupTimeout     time.Duration
+		argKeyLookupFailOpen    bool
+		argKeyLookupMaxStale    time.Duration
+		argKeyLookupConcurrency int
+
 		argDebug   bool
 		argVersion bool
 	)
 	{
 		flag.StringVar(&argListenAddr, "listen", ":2222", "Listen address/port")
-		flag.StringVar(&argAccessConfig, "access", "./access.yaml", "Access config file")
+		flag.StringVar(&argAccessConfig, "access", "./access.yaml", "Access config file or directory of fragments")
+		flag.BoolVar(&argWatchConfig, "watch-config", false, "Reload access config on file changes")
+		flag.DurationVar(&argWatchInterval, "watch-interval", time.Second*2, "Access config file polling interval")
 
 		flag.Var(&argHostPrivateKeys, "private", "Host private key file, repeatable")
 		flag.StringVar(&argHostSocketNetwork, "socket-network", "tcp", "Reverse tunnel socket network")
@@ -49,6 +93,33 @@ func main() {
 		flag.DurationVar(&argIdleTimeout, "idle-timeout", time.Minute*3, "Idle session timeout")
 		flag.DurationVar(&argOverallTimeout, "overall-timeout", 0, "Overall session timeout")
 
+		flag.BoolVar(&argProxyProtocol, "proxy-protocol", false, "Read PROXY protocol v1/v2 headers of load balancers, requires -proxy-protocol-from")
+		flag.Var(&argProxyProtocolFrom, "proxy-protocol-from", "Trusted load balancer address/CIDR allowed to send PROXY protocol headers, implies -proxy-protocol, repeatable")
+		flag.DurationVar(&argProxyProtocolTimeout, "proxy-protocol-timeout", time.Second*5, "PROXY protocol header read timeout")
+
+		flag.IntVar(&argMaxAuthFailures, "max-auth-failures", 0, "Connections per IP failing authentication within -auth-failure-window before a ban, 0 to disable")
+		flag.DurationVar(&argAuthFailureWindow, "auth-failure-window", time.Minute*10, "Window of counted failed authentications")
+		flag.DurationVar(&argBanDuration, "ban-duration", time.Minute*15, "Ban duration")
+		flag.IntVar(&argMaxUnauthenticated, "max-unauthenticated", 0, "Max concurrent connections not authenticated yet, 0 for unlimited")
+		flag.Float64Var(&argMaxConnRate, "max-conn-rate", 0, "Max new connections per second per IP, 0 for unlimited")
+
+		flag.DurationVar(&argKeepaliveInterval, "keepalive-interval", 0, "Interval of keepalive probes sent to clients, 0 to disable")
+		flag.IntVar(&argKeepaliveCountMax, "keepalive-count-max", 3, "Missed keepalives before closing a connection")
+
+		flag.StringVar(&argMetricsListenAddr, "metrics-listen", "", "Prometheus metrics listen address/port, disabled if empty")
+		flag.StringVar(&argAuditLog, "audit-log", "", "Audit log file (JSON Lines), disabled if empty")
+
+		flag.StringVar(&argGrantsFile, "grants-file", "", "Access grants state file, grants are lost on restart if empty")
+		flag.DurationVar(&argGrantMaxDuration, "grant-max-duration", time.Hour*24, "Max access grant duration, 0 for unlimited")
+
+		flag.StringVar(&argKeyLookupCommand, "key-lookup-command", "", "Command to look up keys unknown to the access config")
+		flag.StringVar(&argKeyLookupURL, "key-lookup-url", "", "HTTP endpoint to look up keys unknown to the access config")
+		flag.DurationVar(&argKeyLookupTTL, "key-lookup-ttl", time.Minute, "Key lookup decisions cache TTL")
+		flag.DurationVar(&argKeyLookupTimeout, "key-lookup-timeout", time.Second*5, "Key lookup timeout")
+		flag.BoolVar(&argKeyLookupFailOpen, "key-lookup-fail-open", false, "Use the last known decision if key lookup fails")
+		flag.DurationVar(&argKeyLookupMaxStale, "key-lookup-max-stale", time.Hour, "Max age of the last known decision used if key lookup fails, 0 for unlimited")
+		flag.IntVar(&argKeyLookupConcurrency, "key-lookup-concurrency", 4, "Max concurrent key lookups, keys are rejected while busy, 0 for unlimited")
+
 		flag.BoolVar(&argDebug, "debug", false, "Debug logs")
 		flag.BoolVar(&argVersion, "version", false, "Print version and exit")
 	}
@@ -59,6 +130,9 @@ func main() {
 		fmt.Fprintln(w, "Usage:")
 		flag.PrintDefaults()
 		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Commands:")
+		fmt.Fprintln(w, "  agent - Run puppet agent, see agent --help")
+		fmt.Fprintln(w)
 		fmt.Fprintln(w, "Signals:")
 		fmt.Fprintln(w, "  SIGHUP - Reload access config")
 	}
@@ -86,6 +160,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	// PROXY protocol: headers are optional from trusted balancers and rejected from other peers.
+	// Trusting every peer would let anyone spoof the client address, so the balancers must be listed.
+	if argProxyProtocol && len(argProxyProtocolFrom) == 0 {
+		logging.FromContext(ctx).Error("PROXY protocol requires trusted balancers in -proxy-protocol-from")
+		os.Exit(1)
+	}
+
+	var proxyPolicy proxyproto.PolicyFunc
+	if len(argProxyProtocolFrom) > 0 {
+		var err error
+		proxyPolicy, err = proxyproto.StrictWhiteListPolicy(argProxyProtocolFrom)
+		if err != nil {
+			logging.FromContext(ctx).Error("Failed to parse PROXY protocol trusted sources", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	// Load private keys
 	var hostSigners []ssh.Signer
 	{
@@ -111,53 +202,71 @@ func main() {
 	// Config
 	var accessConfig = &config.AccessConfigHolder{}
 	{
-		f, err := os.OpenFile(argAccessConfig, os.O_RDONLY, 0)
+		v, err := config.LoadAccessConfig(ctx, argAccessConfig)
 		if err != nil {
-			logging.FromContext(ctx).Error("Failed to open access config", "err", err)
+			logging.FromContext(ctx).Error("Failed to load access config", "err", err)
 			os.Exit(1)
 		}
 
-		v, err := config.ParseAccessConfig(ctx, f)
-		f.Close()
+		accessConfig.Store(v)
+	}
+
+	// Audit log
+	var auditLog *audit.Log
+	if argAuditLog != "" {
+		v, err := audit.Open(argAuditLog, logging.FromContext(ctx).WithGroup("audit"))
 		if err != nil {
-			logging.FromContext(ctx).Error("Failed to parse access config", "err", err)
+			logging.FromContext(ctx).Error("Failed to open audit log", "err", err)
 			os.Exit(1)
 		}
+		defer v.Close()
 
-		accessConfig.Store(v)
+		auditLog = v
+	}
 
-		// SIGHUP -> reload access config
-		go func(ctx context.Context) {
-			ch := make(chan os.Signal, 1)
-			defer close(ch)
-			signal.Notify(ch, syscall.SIGHUP)
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case sig := <-ch:
-					logging.FromContext(ctx).Info("Reloading access config by " + sig.String())
-
-					f, err := os.OpenFile(argAccessConfig, os.O_RDONLY, 0)
-					if err != nil {
-						logging.FromContext(ctx).Error("Failed to open access config", "err", err)
-						continue
-					}
-
-					v, err := config.ParseAccessConfig(ctx, f)
-					f.Close()
-					if err != nil {
-						logging.FromContext(ctx).Error("Failed to parse access config", "err", err)
-						continue
-					}
-
-					accessConfig.Store(v)
-				}
-			}
-		}(logging.NewContextGroupWith(ctx, "sighup"))
+	// External key lookup
+	var keyLookup *keylookup.Cache
+	{
+		var source keylookup.Source
+
+		switch {
+		case argKeyLookupCommand != "" && argKeyLookupURL != "":
+			logging.FromContext(ctx).Error("Only one of key lookup command and URL may be provided")
+			os.Exit(1)
+
+		case argKeyLookupCommand != "":
+			source = &keylookup.Command{Path: argKeyLookupCommand, Timeout: argKeyLookupTimeout}
+
+		case argKeyLookupURL != "":
+			source = &keylookup.HTTP{URL: argKeyLookupURL, Client: &http.Client{Timeout: argKeyLookupTimeout}}
+		}
+
+		if source != nil {
+			keyLookup = keylookup.NewCache(source, argKeyLookupTTL, argKeyLookupFailOpen, argKeyLookupMaxStale, argKeyLookupConcurrency)
+		}
+	}
+
+	// Brute force protection, disabled unless a limit is set
+	var authLimiter *limiter.Limiter
+	if argMaxAuthFailures > 0 || argMaxUnauthenticated > 0 || argMaxConnRate > 0 {
+		authLimiter = limiter.New(ctx, limiter.Options{
+			MaxFailures:        argMaxAuthFailures,
+			FailureWindow:      argAuthFailureWindow,
+			BanDuration:        argBanDuration,
+			MaxUnauthenticated: argMaxUnauthenticated,
+			ConnRate:           argMaxConnRate,
+		}, auditLog)
+	}
+
+	// Temporary access grants
+	grants, err := grant.NewStore(argGrantsFile, argGrantMaxDuration, auditLog)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load access grants", "err", err)
+		os.Exit(1)
 	}
 
-	puppetManager := puppet.NewMapper()
+	clientRegistry := client.NewRegistry()
+	puppetManager := puppet.NewMapper(accessConfig, auditLog)
 
 	// Handlers
 	tcpipForwarder, err := tcpipforward.NewTcpipForward(argHostSocketNetwork, puppetManager)
@@ -167,7 +276,55 @@ func main() {
 	}
 	defer tcpipForwarder.Close()
 
-	tcpipDirecter := directtcpip.NewDirectTcpip(puppetManager)
+	tcpipDirecter := directtcpip.NewDirectTcpip(puppetManager, grant.AccessChecker{Config: accessConfig, Grants: grants}, clientRegistry, auditLog)
+
+	// Reloads access config, keeping the current one on failure
+	reloadAccessConfig := func(ctx context.Context, trigger string) {
+		err := func() error {
+			v, err := config.LoadAccessConfig(ctx, argAccessConfig)
+			if err != nil {
+				return err
+			}
+
+			accessConfig.Store(v)
+
+			// Drop what is no longer allowed
+			callback.RevalidateConnections(ctx, v, clientRegistry, tcpipForwarder, grants)
+			return nil
+		}()
+
+		metrics.ConfigReloads.WithLabelValues(trigger, metrics.Result(err)).Inc()
+
+		if err != nil {
+			logging.FromContext(ctx).Error("Failed to reload access config, keeping the current one", "err", err)
+		}
+	}
+
+	// SIGHUP -> reload access config
+	go func(ctx context.Context) {
+		ch := make(chan os.Signal, 1)
+		defer close(ch)
+		signal.Notify(ch, syscall.SIGHUP)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-ch:
+				logging.FromContext(ctx).Info("Reloading access config by " + sig.String())
+				reloadAccessConfig(ctx, "signal")
+			}
+		}
+	}(logging.NewContextGroupWith(ctx, "sighup"))
+
+	// File change -> reload access config
+	if argWatchConfig {
+		go func(ctx context.Context) {
+			config.WatchAccessConfig(ctx, argAccessConfig, argWatchInterval, func() {
+				logging.FromContext(ctx).Info("Reloading access config by file change")
+				reloadAccessConfig(ctx, "watch")
+			})
+		}(logging.NewContextGroupWith(ctx, "watch"))
+	}
 
 	// Server
 	srv := &ssh.Server{
@@ -176,6 +333,9 @@ func main() {
 		IdleTimeout: argIdleTimeout,
 		MaxTimeout:  argOverallTimeout,
 
+		// Dead connections detection
+		ConnCallback: callback.KeepaliveConnCallback(ctx, argKeepaliveInterval, max(argKeepaliveCountMax, 1)),
+
 		ChannelHandlers: map[string]ssh.ChannelHandler{
 			"session":      ssh.DefaultSessionHandler,
 			"direct-tcpip": tcpipDirecter.Handle,
@@ -192,14 +352,18 @@ func main() {
 		},
 
 		// Public key auth
-		PublicKeyHandler: callback.PublicKeyHandler(ctx, accessConfig),
+		PublicKeyHandler: callback.PublicKeyHandler(ctx, accessConfig, keyLookup, authLimiter, auditLog),
+
+		// Authentication is complete once the key is proven by its signature
+		ServerConfigCallback: callback.ServerConfigCallback(clientRegistry, authLimiter, auditLog),
 
 		// Shell/exec session request
 		SessionRequestCallback: callback.SessionRequestCallback(ctx),
 
 		// Shell/exec handler (admins)
 		Handler: callback.SessionExecCallback(
-			command.AdminInterpreter(puppetManager, accessConfig),
+			command.AdminInterpreter(ctx, puppetManager, accessConfig, authLimiter, grants, clientRegistry, tcpipForwarder, auditLog),
+			auditLog,
 		),
 
 		// Reverse/remote port requests (puppets)
@@ -209,6 +373,18 @@ func main() {
 		LocalPortForwardingCallback: callback.LocalPortForwardingCallback(ctx, accessConfig),
 	}
 
+	// Metrics
+	if argMetricsListenAddr != "" {
+		go func() {
+			logger := logging.FromContext(ctx).WithGroup("metrics")
+			logger.Info("Starting metrics server on " + argMetricsListenAddr)
+
+			if err := metrics.Serve(ctx, argMetricsListenAddr); err != nil {
+				logger.Error("Failed to start metrics server", "err", err)
+			}
+		}()
+	}
+
 	// Start server
 	go func() {
 		defer cancel()
@@ -216,7 +392,28 @@ func main() {
 		logger := logging.FromContext(ctx).WithGroup("gossh")
 		logger.Info("Starting server on " + srv.Addr)
 
-		if err := srv.ListenAndServe(); err != nil {
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			logger.Error("Failed to start server", "err", err)
+			return
+		}
+
+		// Real client addresses from load balancers
+		if proxyPolicy != nil {
+			logger.Info("PROXY protocol is enabled")
+			ln = &proxyproto.Listener{
+				Listener:          ln,
+				Policy:            proxyPolicy,
+				ReadHeaderTimeout: argProxyProtocolTimeout,
+			}
+		}
+
+		// Limits apply to real client addresses, so the limiter goes on top
+		if authLimiter != nil {
+			ln = authLimiter.Listener(ln)
+		}
+
+		if err := srv.Serve(ln); err != nil {
 			if !errors.Is(err, ssh.ErrServerClosed) {
 				logger.Error("Failed to start server", "err", err)
 			}